@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/geovex/tgp/internal/config"
+	"github.com/geovex/tgp/internal/tgcrypt_encryption"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage:
+  tgp run <config_path.toml>
+  tgp check-config <config_path.toml>
+  tgp show-config <config_path.toml>
+  tgp gen-secret [--type simple|dd|ee] [--host example.com]
+  tgp links <config_path.toml> --public-host <host> [--port <port>]
+`)
+}
+
+// parse flags allowing them to be mixed with positional arguments
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		err := fs.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// parse arguments of command that requires only config path
+func configPathArg(fs *flag.FlagSet, args []string) (string, error) {
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return "", err
+	}
+	if len(positional) != 1 {
+		return "", fmt.Errorf("%s: config path required", fs.Name())
+	}
+	return positional[0], nil
+}
+
+func runCmd(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	path, err := configPathArg(fs, args)
+	if err != nil {
+		return err
+	}
+	c, err := config.ReadConfig(path)
+	if err != nil {
+		return err
+	}
+	setupLogging(c)
+	return newServer(c, path).run()
+}
+
+func checkConfigCmd(args []string) error {
+	fs := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	path, err := configPathArg(fs, args)
+	if err != nil {
+		return err
+	}
+	problems := config.CheckConfig(path)
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s: %d problems found", path, len(problems))
+	}
+	fmt.Printf("%s: ok\n", path)
+	return nil
+}
+
+// print effective config with credentials redacted
+func showConfigCmd(args []string) error {
+	fs := flag.NewFlagSet("show-config", flag.ContinueOnError)
+	path, err := configPathArg(fs, args)
+	if err != nil {
+		return err
+	}
+	c, err := config.ReadConfig(path)
+	if err != nil {
+		return err
+	}
+	return c.WriteEffective(os.Stdout)
+}
+
+func genSecretCmd(args []string) error {
+	fs := flag.NewFlagSet("gen-secret", flag.ContinueOnError)
+	secretType := fs.String("type", "dd", "secret type: simple, dd (secured) or ee (faketls)")
+	host := fs.String("host", "", "fake host for ee secret")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return fmt.Errorf("gen-secret: unexpected arguments: %v", positional)
+	}
+	var t tgcrypt_encryption.SecretType
+	switch *secretType {
+	case "simple":
+		t = tgcrypt_encryption.Simple
+	case "dd":
+		t = tgcrypt_encryption.Secured
+	case "ee":
+		t = tgcrypt_encryption.FakeTLS
+	default:
+		return fmt.Errorf("gen-secret: unknown secret type %s", *secretType)
+	}
+	if *host != "" && t != tgcrypt_encryption.FakeTLS {
+		return fmt.Errorf("gen-secret: --host is used only with ee secrets")
+	}
+	secret, err := tgcrypt_encryption.GenerateSecret(t, *host)
+	if err != nil {
+		return err
+	}
+	fmt.Println(secret.Hex())
+	return nil
+}
+
+func linksCmd(args []string) error {
+	fs := flag.NewFlagSet("links", flag.ContinueOnError)
+	publicHost := fs.String("public-host", "", "host or ip clients connect to")
+	port := fs.String("port", "", "port clients connect to (default is port of first listen_url)")
+	path, err := configPathArg(fs, args)
+	if err != nil {
+		return err
+	}
+	if *publicHost == "" {
+		return errors.New("links: --public-host required")
+	}
+	c, err := config.ReadConfig(path)
+	if err != nil {
+		return err
+	}
+	if *port == "" {
+		urls := c.GetListenUrl()
+		if len(urls) == 0 {
+			return errors.New("links: no tcp listen_url, --port required")
+		}
+		_, *port, err = net.SplitHostPort(urls[0])
+		if err != nil {
+			return fmt.Errorf("links: can't get port from listen_url: %w", err)
+		}
+	}
+	now := time.Now()
+	for _, name := range slices.Sorted(c.IterateUsers()) {
+		u, err := c.GetUser(name)
+		if err != nil {
+			return err
+		}
+		status := ""
+		if u.Disabled {
+			status = " (disabled)"
+		} else if u.Expires != nil {
+			state := "expires"
+			if !u.Active(now) {
+				state = "expired"
+			}
+			status = fmt.Sprintf(" (%s %s)", state, u.Expires.UTC().Format(time.RFC3339))
+		}
+		fmt.Printf("%s%s:\n", name, status)
+		// links of expired secrets are not printed, secret names are shown
+		// for users with several secrets
+		secrets := u.AllSecrets()
+		indent := "  "
+		if len(secrets) > 1 {
+			indent = "    "
+		}
+		for _, s := range secrets {
+			if !s.Active(now) {
+				continue
+			}
+			if len(secrets) > 1 {
+				fmt.Printf("  secret %s", s.Label)
+				if s.NotAfter != nil {
+					fmt.Printf(" (until %s)", s.NotAfter.UTC().Format(time.RFC3339))
+				}
+				fmt.Println(":")
+			}
+			query := fmt.Sprintf("server=%s&port=%s&secret=%s",
+				url.QueryEscape(*publicHost), url.QueryEscape(*port), url.QueryEscape(s.Secret))
+			fmt.Printf("%stg://proxy?%s\n%shttps://t.me/proxy?%s\n", indent, query, indent, query)
+		}
+	}
+	return nil
+}
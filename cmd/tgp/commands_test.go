@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// write config to temporary file and return its path
+func writeConfig(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLinksUnixOnly(t *testing.T) {
+	path := writeConfig(t, `
+		secret = "dd000102030405060708090a0b0c0d0e0f"
+		[[listen_url]]
+		unix = "/tmp/tgp-test.sock"
+	`)
+	err := linksCmd([]string{"--public-host", "example.com", path})
+	if err == nil || !strings.Contains(err.Error(), "--port") {
+		t.Errorf("links without tcp listener and port: %v", err)
+	}
+	err = linksCmd([]string{"--public-host", "example.com", "--port", "443", path})
+	if err != nil {
+		t.Errorf("links with port failed: %v", err)
+	}
+}
+
+func TestGenSecretHost(t *testing.T) {
+	for _, secretType := range []string{"simple", "dd"} {
+		if err := genSecretCmd([]string{"--type", secretType, "--host", "example.com"}); err == nil {
+			t.Errorf("--host accepted for %s secret", secretType)
+		}
+	}
+	if err := genSecretCmd([]string{"--type", "ee", "--host", "example.com"}); err != nil {
+		t.Errorf("ee secret with host failed: %v", err)
+	}
+}
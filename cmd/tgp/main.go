@@ -1,69 +1,469 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
+	"net/netip"
 	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/geovex/tgp/internal/access_log"
 	"github.com/geovex/tgp/internal/config"
+	"github.com/geovex/tgp/internal/ip_guard"
 	o "github.com/geovex/tgp/internal/network_exchange"
+	"github.com/geovex/tgp/internal/proxy_protocol"
 	"github.com/geovex/tgp/internal/stats"
 )
 
+// log level can be changed on config reload
+var logLevel slog.LevelVar
+
+// set default logger according to config
+func setupLogging(c *config.Config) {
+	logLevel.Set(c.GetLogLevel())
+	opts := &slog.HandlerOptions{Level: &logLevel}
+	var handler slog.Handler
+	if c.GetLogJson() {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
 type server struct {
 	stats *stats.Stats
-	conf  *config.Config
+	guard *ip_guard.Guard
+	// config is replaced on reload, running sessions keep their snapshot
+	conf     atomic.Pointer[config.Config]
+	confPath string
+	// serializes config and users file reloads
+	reloadLock sync.Mutex
+	// listeners are kept to stop accepting on shutdown
+	lock      sync.Mutex
+	listeners []net.Listener
+	stopping  bool
+	// state file opened at start, empty if disabled
+	statePath string
 }
 
-func newServer(conf *config.Config) *server {
-	return &server{
-		stats: stats.New(),
-		conf:  conf,
+func newServer(conf *config.Config, confPath string) *server {
+	s := &server{
+		stats:    stats.New(),
+		guard:    ip_guard.New(conf.GetIPLimits()),
+		confPath: confPath,
 	}
+	s.conf.Store(conf)
+	return s
+}
+
+func (s *server) config() *config.Config {
+	return s.conf.Load()
 }
 
-func (s *server) handleListener(url string) error {
-	fmt.Printf("listen: %s\n", url)
-	l, err := net.Listen("tcp", url)
+// reread config file and use it for new connections. Invalid config is
+// rejected and old one is kept.
+func (s *server) reload() error {
+	if s.confPath == "" {
+		return fmt.Errorf("no config file to reload")
+	}
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	newConf, err := config.ReadConfig(s.confPath)
+	if err != nil {
+		return err
+	}
+	oldConf := s.conf.Swap(newConf)
+	logUserErrors(newConf)
+	logLevel.Set(newConf.GetLogLevel())
+	s.guard.SetLimits(newConf.GetIPLimits())
+	for _, msg := range restartRequired(oldConf, newConf) {
+		slog.Warn(msg)
+	}
+	s.closeChangedUsers(oldConf, newConf)
+	return nil
+}
+
+// changes of settings that are not applied on reload
+func restartRequired(oldConf, newConf *config.Config) []string {
+	var msgs []string
+	for _, l := range newConf.GetListeners() {
+		old := oldConf.GetListener(l.String())
+		if old == nil {
+			msgs = append(msgs, fmt.Sprintf("listener %s added, it requires restart", l.String()))
+		} else if old.ProxyProtocol != l.ProxyProtocol || old.NoDelay != l.NoDelay || old.KeepAlive != l.KeepAlive {
+			msgs = append(msgs, fmt.Sprintf("listener %s socket option changes require restart", l.String()))
+		}
+	}
+	for _, l := range oldConf.GetListeners() {
+		if newConf.GetListener(l.String()) == nil {
+			msgs = append(msgs, fmt.Sprintf("listener %s removed, it keeps accepting until restart", l.String()))
+		}
+	}
+	if oldConf.GetLogJson() != newConf.GetLogJson() {
+		msgs = append(msgs, "log_format change requires restart")
+	}
+	if oldConf.GetMetricsListen() != newConf.GetMetricsListen() {
+		msgs = append(msgs, "metrics_listen change requires restart")
+	}
+	oldSock, newSock := oldConf.GetStatsSock(), newConf.GetStatsSock()
+	if (oldSock == nil) != (newSock == nil) || oldSock != nil && *oldSock != *newSock {
+		msgs = append(msgs, "stats_sock change requires restart")
+	}
+	if oldConf.GetStateFile() != newConf.GetStateFile() {
+		msgs = append(msgs, "state file changes require restart")
+	}
+	return msgs
+}
+
+// close sessions of removed or changed users if reload_terminate is set
+func (s *server) closeChangedUsers(oldConf, newConf *config.Config) {
+	if !newConf.GetReloadTerminate() {
+		return
+	}
+	for _, name := range s.stats.ActiveUsers() {
+		oldUser, _ := oldConf.GetUser(name)
+		newUser, err := newConf.GetUser(name)
+		if err != nil || !reflect.DeepEqual(oldUser, newUser) {
+			closed := s.stats.CloseUser(name, stats.ReasonUserChanged)
+			slog.Info("user changed, sessions closed", "user", name, "closed", closed)
+		}
+	}
+}
+
+// how often users file is checked for changes
+const usersFileCheckInterval = 5 * time.Second
+
+// reload users file if it was changed, other settings are kept
+func (s *server) checkUsersFile() {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	oldConf := s.config()
+	if !oldConf.UsersFileChanged() {
+		return
+	}
+	newConf, err := oldConf.ReloadUsers()
+	if err != nil {
+		slog.Error("users file reload failed, keeping old users", "error", err)
+		return
+	}
+	s.conf.Store(newConf)
+	logUserErrors(newConf)
+	slog.Info("users file reloaded", "path", newConf.GetUsersFile(), "skipped", len(newConf.GetUserErrors()))
+	s.closeChangedUsers(oldConf, newConf)
+}
+
+// log skipped users file entries
+func logUserErrors(conf *config.Config) {
+	for _, err := range conf.GetUserErrors() {
+		slog.Warn("users file entry skipped", "error", err)
+	}
+}
+
+// reload config and log result
+func (s *server) reloadAndLog() error {
+	err := s.reload()
+	if err != nil {
+		slog.Error("config reload failed, keeping old config", "error", err)
+	} else {
+		slog.Info("config reloaded")
+	}
+	return err
+}
+
+// remember listener to close it on shutdown. Returns false if server is
+// already stopping.
+func (s *server) addListener(l net.Listener) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stopping {
+		return false
+	}
+	s.listeners = append(s.listeners, l)
+	return true
+}
+
+// stop all listeners. Accept loops will exit with net.ErrClosed
+func (s *server) closeListeners() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stopping = true
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.listeners = nil
+}
+
+func (s *server) handleListener(listener config.Listener) error {
+	slog.Info("listen", "listener", listener.String())
+	var l net.Listener
+	var err error
+	if listener.Unix != "" {
+		os.Remove(listener.Unix)
+		l, err = net.Listen("unix", listener.Unix)
+	} else {
+		lc := net.ListenConfig{KeepAlive: listener.KeepAlive}
+		l, err = lc.Listen(context.Background(), "tcp", listener.Url)
+	}
 	if err != nil {
 		return err
 	}
 	defer l.Close()
+	if !s.addListener(l) {
+		return nil
+	}
 	for {
 		conn, err := l.Accept()
-		if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
 			return err
 		}
 		sock, ok := conn.(*net.TCPConn)
 		if ok {
-			sock.SetNoDelay(true)
+			sock.SetNoDelay(listener.NoDelay)
 		}
-		oh := o.NewClient(s.conf, s.stats.AllocClient(), conn)
-		go oh.HandleClient()
-		//oh.HandleClient()
+		go s.serveConn(conn, &listener)
 	}
 }
 
-func (s *server) run() error {
-	proxy := make(chan error, 1)
-	defer close(proxy)
-	for _, url := range s.conf.GetListenUrl() {
-		go func(u string) { proxy <- s.handleListener(u) }(url)
-	}
-	stats := make(chan error, 1)
-	defer close(stats)
-	go func() { stats <- s.listenForStats() }()
-	errProxy := <-proxy
-	errStats := <-stats
-	if errProxy != nil || errStats != nil {
-		return fmt.Errorf("server stopped with errors: proxy: %v, stats: %v", errProxy, errStats)
-	} else {
+// time to wait for PROXY protocol header
+const proxyHeaderTimeout = 5 * time.Second
+
+func (s *server) serveConn(conn net.Conn, listener *config.Listener) {
+	if listener.ProxyProtocol {
+		conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		pconn, err := proxy_protocol.ReadHeader(conn)
+		if err != nil {
+			slog.Info("rejected connection", "remote", conn.RemoteAddr().String(), "listener", listener.String(), "error", err)
+			conn.Close()
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		conn = pconn
+	}
+	conf := s.config()
+	// listener options may be changed by reload
+	if l := conf.GetListener(listener.String()); l != nil {
+		listener = l
+	}
+	ip, hasIP := remoteIP(conn)
+	if !hasIP {
+		o.NewClient(conf, listener, s.stats.AllocClient(conn, listener.String()), conn).HandleClient()
+		return
+	}
+	switch s.guard.Admit(ip) {
+	case ip_guard.Banned:
+		if conf.GetBanFallback() {
+			o.NewClient(conf, listener, s.stats.AllocClient(conn, listener.String()), conn).HandleBanned()
+		} else {
+			s.reject(conn, listener, stats.ReasonBanned)
+		}
+		return
+	case ip_guard.Limited:
+		s.reject(conn, listener, stats.ReasonIPLimit)
+		return
+	}
+	defer s.guard.Release(ip)
+	oh := o.NewClient(conf, listener, s.stats.AllocClient(conn, listener.String()), conn)
+	oh.SetAuthFailHandler(func() {
+		if s.guard.Fail(ip) {
+			slog.Warn("banned ip for failed handshakes", "ip", ip)
+		}
+	})
+	oh.HandleClient()
+}
+
+// close connection without handling, reason is recorded in stats
+func (s *server) reject(conn net.Conn, listener *config.Listener, reason stats.CloseReason) {
+	sh := s.stats.AllocClient(conn, listener.String())
+	sh.SetCloseReason(reason)
+	sh.Close()
+	conn.Close()
+}
+
+// ip address of client, unix socket clients have no address
+func remoteIP(conn net.Conn) (netip.Addr, bool) {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	return addr.AddrPort().Addr().Unmap(), true
+}
+
+// write finished sessions to access log if it's configured
+func (s *server) openAccessLog() (*access_log.Log, error) {
+	cfg := s.config().GetAccessLog()
+	if cfg.Path == "" {
+		return nil, nil
+	}
+	l, err := access_log.New(cfg.Path, int64(cfg.MaxSize), cfg.MaxFiles)
+	if err != nil {
+		return nil, err
+	}
+	s.stats.SetSessionLog(func(session stats.Session) {
+		err := l.Write(session)
+		if err != nil {
+			slog.Error("can't write access log", "error", err)
+		}
+	})
+	return l, nil
+}
+
+// load saved user totals and flush them periodically. Returned function
+// stops flushing and saves final state.
+func (s *server) startState() (func(), error) {
+	state := s.config().GetStateFile()
+	if state.Path == "" {
+		return func() {}, nil
+	}
+	err := s.stats.LoadState(state.Path)
+	if err != nil {
+		return nil, err
+	}
+	s.statePath = state.Path
+	stop := runEvery(state.FlushInterval, func() { s.saveState() })
+	return func() {
+		stop()
+		s.saveState()
+	}, nil
+}
+
+// call fn periodically until returned function is called
+func runEvery(interval time.Duration, fn func()) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// how often sessions are checked against user quotas and expiry
+const userCheckInterval = 5 * time.Second
+
+// close sessions of expired or disabled users and users who used their quota
+func (s *server) enforceUsers() {
+	conf := s.config()
+	for _, name := range s.stats.ActiveUsers() {
+		u, err := conf.GetUser(name)
+		if err != nil {
+			continue
+		}
+		if reason := u.InactiveReason(time.Now()); reason != "" {
+			closed := s.stats.CloseUser(name, reason)
+			slog.Info("user is not active, sessions closed", "user", name, "reason", reason, "closed", closed)
+		} else if s.stats.OverQuota(name, uint64(*u.Quota), *u.QuotaPeriod) {
+			closed := s.stats.CloseUser(name, stats.ReasonQuotaExceeded)
+			slog.Info("quota exceeded, sessions closed", "user", name, "closed", closed)
+		}
+	}
+}
+
+// write user totals to state file if it's enabled
+func (s *server) saveState() error {
+	if s.statePath == "" {
 		return nil
 	}
+	err := s.stats.SaveState(s.statePath)
+	if err != nil {
+		slog.Error("can't save state", "error", err)
+	}
+	return err
+}
+
+func (s *server) run() error {
+	accessLog, err := s.openAccessLog()
+	if err != nil {
+		return err
+	}
+	if accessLog != nil {
+		defer accessLog.Close()
+	}
+	stopState, err := s.startState()
+	if err != nil {
+		return err
+	}
+	defer stopState()
+	defer runEvery(userCheckInterval, s.enforceUsers)()
+	logUserErrors(s.config())
+	defer runEvery(usersFileCheckInterval, s.checkUsersFile)()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	defer signal.Stop(hups)
+	listeners := s.config().GetListeners()
+	errs := make(chan error, len(listeners)+2)
+	for _, l := range listeners {
+		go func(l config.Listener) { errs <- s.handleListener(l) }(l)
+	}
+	go func() { errs <- s.listenForStats() }()
+	go func() { errs <- s.listenForMetrics() }()
+	for err == nil {
+		select {
+		case sig := <-sigs:
+			slog.Info("shutting down", "signal", sig.String())
+			s.shutdown(sigs)
+			return nil
+		case <-hups:
+			s.reloadAndLog()
+		case err = <-errs:
+			// stats and metrics listeners return nil if they are disabled
+		}
+	}
+	s.shutdown(sigs)
+	return fmt.Errorf("server stopped with error: %w", err)
 }
 
+// stop accepting new connections and wait for active sessions to finish.
+// Sessions left after drain timeout (or second signal) are closed forcibly.
+func (s *server) shutdown(sigs <-chan os.Signal) {
+	s.closeListeners()
+	timeout := s.config().GetDrainTimeout()
+	slog.Info("waiting for sessions to finish", "timeout", timeout.String(), "sessions", s.stats.Count())
+	drained := make(chan bool, 1)
+	go func() { drained <- s.stats.WaitEmpty(timeout) }()
+	select {
+	case ok := <-drained:
+		if ok {
+			return
+		}
+	case sig := <-sigs:
+		slog.Info("closing sessions", "signal", sig.String())
+	}
+	slog.Info("closing remaining sessions", "sessions", s.stats.CloseAll())
+	// let closed sessions finish their records
+	s.stats.WaitEmpty(closeWaitTimeout)
+}
+
+// time for forcibly closed sessions to exit
+const closeWaitTimeout = time.Second
+
 func (s *server) listenForStats() error {
-	sockPath := s.conf.GetStatsSock()
+	sockPath := s.config().GetStatsSock()
 	if sockPath == nil || *sockPath == "" {
 		//no stats socket specified
 		return nil
@@ -74,32 +474,46 @@ func (s *server) listenForStats() error {
 		return err
 	}
 	defer l.Close()
+	if !s.addListener(l) {
+		return nil
+	}
 	for {
 		conn, err := l.Accept()
-		if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
 			return err
 		}
-		statsString := s.stats.AsString()
-		conn.Write([]byte(statsString))
-		conn.Close()
+		go s.handleStatsConn(conn)
 	}
 }
 
 func main() {
-	var c *config.Config
-	if len(os.Args) > 1 {
-		var err error
-		c, err = config.ReadConfig(os.Args[1])
-		if err != nil {
-			panic(err)
-		}
-	} else {
-		c = config.DefaultConfig()
-	}
-	cl := newServer(c)
-	cl.run()
-	// err := cl.run()
-	// if err != nil {
-	// 	panic(err)
-	// }
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	var err error
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "run":
+		err = runCmd(args)
+	case "check-config":
+		err = checkConfigCmd(args)
+	case "show-config":
+		err = showConfigCmd(args)
+	case "gen-secret":
+		err = genSecretCmd(args)
+	case "links":
+		err = linksCmd(args)
+	case "help", "-h", "-help", "--help":
+		usage()
+	default:
+		// old form: tgp <config_path>
+		err = runCmd(os.Args[1:])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
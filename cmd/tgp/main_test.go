@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/geovex/tgp/internal/config"
+)
+
+func TestReloadInvalidConfig(t *testing.T) {
+	path := writeConfig(t, testServerConfig)
+	c, err := config.ReadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(c, path)
+	if err := os.WriteFile(path, []byte(testServerConfig+"\nunknown_option = 1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.reload(); err == nil {
+		t.Errorf("invalid config accepted on reload")
+	}
+	if s.config() != c {
+		t.Errorf("old config replaced by invalid one")
+	}
+}
+
+func TestReloadTerminate(t *testing.T) {
+	config := `
+		listen_url = "127.0.0.1:0"
+		reload_terminate = true
+		[users]
+		a = "dd000102030405060708090a0b0c0d0e0f"
+		b = "dd101112131415161718191a1b1c1d1e1f"
+		c = "dd202122232425262728292a2b2c2d2e2f"
+	`
+	path := writeConfig(t, config)
+	s := testServer(t, config)
+	s.confPath = path
+	conns := map[string]*testConn{}
+	for i, name := range []string{"a", "b", "c"} {
+		conn := &testConn{remote: &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 1000}}
+		s.stats.AllocClient(conn, "test").SetAuthorized(name)
+		conns[name] = conn
+	}
+	// a is removed, b is changed
+	changed := `
+		listen_url = "127.0.0.1:0"
+		reload_terminate = true
+		[users]
+		b = {secret = "dd101112131415161718191a1b1c1d1e1f", max_connections = 1}
+		c = "dd202122232425262728292a2b2c2d2e2f"
+	`
+	if err := os.WriteFile(path, []byte(changed), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if !conns["a"].closed || !conns["b"].closed || conns["c"].closed {
+		t.Errorf("wrong sessions closed on reload")
+	}
+}
+
+func TestEmptyConnectNotBanned(t *testing.T) {
+	s := testServer(t, "ban_failures = 1\n"+testServerConfig)
+	listener := &s.config().GetListeners()[0]
+	connect := func(data []byte) {
+		server, client := net.Pipe()
+		go func() {
+			client.Write(data)
+			client.Close()
+		}()
+		s.serveConn(&testConn{Conn: server, remote: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}}, listener)
+		server.Close()
+	}
+	connect(nil)
+	connect(nil)
+	if bans := s.guard.Bans(); len(bans) != 0 {
+		t.Errorf("empty connections banned: %v", bans)
+	}
+	connect(make([]byte, 10))
+	if len(s.guard.Bans()) != 1 {
+		t.Errorf("failed handshake not banned")
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	oldConf := testServer(t, testServerConfig).config()
+	newConf := testServer(t, `
+		listen_url = "127.0.0.1:1"
+		log_format = "json"
+		stats_sock = "tgp.stats"
+		[users]
+		a = "dd000102030405060708090a0b0c0d0e0f"
+	`).config()
+	msgs := restartRequired(oldConf, newConf)
+	for _, want := range []string{"127.0.0.1:1 added", "127.0.0.1:0 removed", "log_format", "stats_sock"} {
+		if !slices.ContainsFunc(msgs, func(m string) bool { return strings.Contains(m, want) }) {
+			t.Errorf("no %q in %q", want, msgs)
+		}
+	}
+	if msgs := restartRequired(oldConf, oldConf); len(msgs) != 0 {
+		t.Errorf("unexpected messages for same config %q", msgs)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+
+	o "github.com/geovex/tgp/internal/network_exchange"
+	"github.com/geovex/tgp/internal/stats"
+)
+
+// serve prometheus metrics over http if metrics_listen is set
+func (s *server) listenForMetrics() error {
+	addr := s.config().GetMetricsListen()
+	if addr == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if !s.addListener(l) {
+		return nil
+	}
+	slog.Info("serving metrics", "address", addr)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	err = http.Serve(l, mux)
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", stats.MetricsContentType)
+	m := stats.NewMetricsWriter(w)
+	s.stats.WriteMetrics(m)
+
+	m.Family("tgp_banned_ips", "gauge", "Currently banned client addresses.")
+	m.Sample("tgp_banned_ips", float64(len(s.guard.Bans())))
+
+	mp := o.GetMiddleProxyStatus()
+	if mp.Attempted {
+		m.Family("tgp_middle_proxy_refresh_ok", "gauge", "Last middle proxy config refresh succeeded.")
+		m.Sample("tgp_middle_proxy_refresh_ok", boolMetric(mp.Ok))
+		m.Family("tgp_middle_proxy_refresh_failures_total", "counter", "Failed middle proxy config refreshes.")
+		m.Sample("tgp_middle_proxy_refresh_failures_total", float64(mp.Failures))
+		m.Family("tgp_middle_proxy_refresh_last_attempt_timestamp_seconds", "gauge", "Time of last middle proxy config refresh.")
+		m.Sample("tgp_middle_proxy_refresh_last_attempt_timestamp_seconds", float64(mp.LastAttempt.Unix()))
+		if !mp.LastSuccess.IsZero() {
+			m.Family("tgp_middle_proxy_refresh_last_success_timestamp_seconds", "gauge", "Time of last successful middle proxy config refresh.")
+			m.Sample("tgp_middle_proxy_refresh_last_success_timestamp_seconds", float64(mp.LastSuccess.Unix()))
+		}
+	}
+	if m.Err() != nil {
+		slog.Debug("metrics write failed", "error", m.Err())
+	}
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
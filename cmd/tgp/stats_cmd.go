@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geovex/tgp/internal/ip_guard"
+	"github.com/geovex/tgp/internal/stats"
+)
+
+const (
+	// time to wait for optional first command from stats socket client
+	statsCmdTimeout = 200 * time.Millisecond
+	// time to wait for following commands
+	statsSessionTimeout = time.Minute
+)
+
+const statsHelp = `commands (append "json" for json output):
+  stats
+  clients
+  users
+  user <name>
+  bans
+  unban <address>
+  latency
+  kick id <id> | kick user <name> | kick ip <address>
+  reset user <name> | reset all
+  reload
+`
+
+// Reply to stats socket client. If client sends nothing stats are returned in
+// text form. Otherwise every line is a command and connection is kept until
+// client closes it.
+func (s *server) handleStatsConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(statsCmdTimeout))
+	line, err := r.ReadString('\n')
+	if strings.TrimSpace(line) == "" && err != nil {
+		s.statsCmd(conn, nil, false)
+		return
+	}
+	for {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			cmd, args, asJson := parseStatsCmd(fields)
+			s.statsCmd(conn, append([]string{cmd}, args...), asJson)
+		}
+		if err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(statsSessionTimeout))
+		line, err = r.ReadString('\n')
+	}
+}
+
+// split command line to command, arguments and json flag
+func parseStatsCmd(fields []string) (cmd string, args []string, asJson bool) {
+	cmd, args = fields[0], fields[1:]
+	// "user json" is request for user named json
+	minArgs := 0
+	if cmd == "user" {
+		minArgs = 1
+	} else if cmd == "reset" && len(args) > 0 && args[0] == "user" {
+		minArgs = 2
+	}
+	if len(args) > minArgs && args[len(args)-1] == "json" {
+		return cmd, args[:len(args)-1], true
+	}
+	return cmd, args, false
+}
+
+// write reply to command, empty command means stats
+func (s *server) statsCmd(w io.Writer, cmd []string, asJson bool) {
+	if len(cmd) == 0 {
+		cmd = []string{"stats"}
+	}
+	var reply any
+	var text string
+	var err error
+	switch cmd[0] {
+	case "stats":
+		reply = struct {
+			stats.Summary
+			Bans []ip_guard.Ban `json:"bans"`
+		}{s.stats.Summary(), s.guard.Bans()}
+		text = s.stats.AsString() + "\n" + s.guard.AsString()
+	case "clients":
+		clients := s.stats.Clients()
+		reply = clients
+		text = clientsText(clients)
+	case "users":
+		users := s.users()
+		reply = users
+		text = usersText(users)
+	case "user":
+		if len(cmd) != 2 {
+			err = fmt.Errorf("usage: user <name>")
+			break
+		}
+		reply, text, err = s.userReply(cmd[1])
+	case "bans":
+		reply = s.guard.Bans()
+		text = s.guard.AsString()
+	case "unban":
+		var unbanned bool
+		unbanned, err = s.unban(cmd[1:])
+		reply = map[string]bool{"unbanned": unbanned}
+		text = "ip was not banned\n"
+		if unbanned {
+			text = "unbanned\n"
+		}
+	case "latency":
+		latency := s.stats.Latency()
+		reply = latency
+		text = latency.AsString()
+	case "kick":
+		var kicked int
+		kicked, err = s.kick(cmd[1:])
+		reply = map[string]int{"kicked": kicked}
+		text = fmt.Sprintf("kicked %d connections\n", kicked)
+	case "reset":
+		err = s.reset(cmd[1:])
+		reply = map[string]bool{"reset": true}
+		text = "reset\n"
+	case "reload":
+		err = s.reloadAndLog()
+		reply = map[string]bool{"reloaded": true}
+		text = "reloaded\n"
+	case "help":
+		reply = map[string]string{"help": statsHelp}
+		text = statsHelp
+	default:
+		err = fmt.Errorf("unknown command %q, try help", cmd[0])
+	}
+	writeStatsReply(w, reply, text, err, asJson)
+}
+
+func writeStatsReply(w io.Writer, reply any, text string, err error, asJson bool) {
+	if asJson {
+		if err != nil {
+			reply = map[string]string{"error": err.Error()}
+		}
+		data, _ := json.Marshal(reply)
+		w.Write(append(data, '\n'))
+	} else if err != nil {
+		fmt.Fprintf(w, "error: %v\n", err)
+	} else {
+		io.WriteString(w, text)
+	}
+}
+
+// close connections by id, user or ip
+func (s *server) kick(args []string) (int, error) {
+	if len(args) != 2 {
+		return 0, fmt.Errorf("usage: kick id|user|ip <value>")
+	}
+	var kicked int
+	switch args[0] {
+	case "id":
+		id, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid connection id %q", args[1])
+		}
+		kicked = s.stats.KickID(id)
+	case "user":
+		kicked = s.stats.KickUser(args[1])
+	case "ip":
+		ip, err := netip.ParseAddr(args[1])
+		if err != nil {
+			return 0, fmt.Errorf("invalid ip %q", args[1])
+		}
+		kicked = s.stats.KickIP(ip)
+	default:
+		return 0, fmt.Errorf("can't kick by %q, use id, user or ip", args[0])
+	}
+	slog.Info("connections kicked", "by", args[0], "value", args[1], "kicked", kicked)
+	return kicked, nil
+}
+
+// lift ban of ip before its expiry
+func (s *server) unban(args []string) (bool, error) {
+	if len(args) != 1 {
+		return false, fmt.Errorf("usage: unban <address>")
+	}
+	ip, err := netip.ParseAddr(args[0])
+	if err != nil {
+		return false, fmt.Errorf("invalid ip %q", args[0])
+	}
+	unbanned := s.guard.Unban(ip.Unmap())
+	if unbanned {
+		slog.Info("ip unbanned", "ip", ip)
+	}
+	return unbanned, nil
+}
+
+// clear cumulative totals of one or all users
+func (s *server) reset(args []string) error {
+	switch {
+	case len(args) == 2 && args[0] == "user":
+		s.stats.ResetUserTotals(args[1])
+	case len(args) == 1 && args[0] == "all":
+		s.stats.ResetUserTotals("")
+	default:
+		return fmt.Errorf("usage: reset user <name> | reset all")
+	}
+	slog.Info("user totals reset", "args", strings.Join(args, " "))
+	return s.saveState()
+}
+
+// stats of configured users and users seen since start
+func (s *server) users() map[string]stats.UserInfo {
+	users := s.stats.Users()
+	conf := s.config()
+	for name := range conf.IterateUsers() {
+		info := users[name]
+		if u, err := conf.GetUser(name); err == nil {
+			info.Expires = u.Expires
+			info.Disabled = u.Disabled
+		}
+		users[name] = info
+	}
+	return users
+}
+
+type userReply struct {
+	Name string `json:"name"`
+	stats.UserInfo
+	Clients []stats.ClientInfo `json:"clients"`
+}
+
+func (s *server) userReply(name string) (*userReply, string, error) {
+	info, ok := s.users()[name]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown user %s", name)
+	}
+	reply := &userReply{Name: name, UserInfo: info, Clients: []stats.ClientInfo{}}
+	for _, c := range s.stats.Clients() {
+		if c.User == name {
+			reply.Clients = append(reply.Clients, c)
+		}
+	}
+	text := usersText(map[string]stats.UserInfo{name: info}) + clientsText(reply.Clients)
+	return reply, text, nil
+}
+
+func clientsText(clients []stats.ClientInfo) string {
+	b := &strings.Builder{}
+	for _, c := range clients {
+		fmt.Fprintf(b, "id=%d user=%s secret=%s remote=%s listener=%s state=%s transport=%s protocol=%s dc=%d egress=%s start=%s duration=%s up=%d down=%d\n",
+			c.ID, c.User, c.Secret, c.Remote, c.Listener, c.State, c.Transport, c.Protocol, c.DC, c.Egress,
+			c.Start.UTC().Format(time.RFC3339), time.Duration(c.Duration*float64(time.Second)).Round(time.Second),
+			c.BytesUp, c.BytesDown)
+	}
+	return b.String()
+}
+
+func usersText(users map[string]stats.UserInfo) string {
+	b := &strings.Builder{}
+	for _, name := range slices.Sorted(maps.Keys(users)) {
+		u := users[name]
+		fmt.Fprintf(b, "%s: %d connections, %d sessions, up %d bytes %d msgs, down %d bytes %d msgs",
+			name, u.Connections, u.Sessions, u.BytesUp, u.MsgsUp, u.BytesDown, u.MsgsDown)
+		for _, reason := range slices.Sorted(maps.Keys(u.Refused)) {
+			fmt.Fprintf(b, ", refused %s %d", reason, u.Refused[reason])
+		}
+		if u.Disabled {
+			b.WriteString(", disabled")
+		}
+		if u.Expires != nil {
+			fmt.Fprintf(b, ", expires %s", u.Expires.UTC().Format(time.RFC3339))
+		}
+		for _, label := range slices.Sorted(maps.Keys(u.Secrets)) {
+			s := u.Secrets[label]
+			fmt.Fprintf(b, ", secret %s %d connections %d sessions last used %s",
+				label, s.Connections, s.Sessions, s.LastUsed.UTC().Format(time.RFC3339))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
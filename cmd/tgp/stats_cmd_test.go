@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/geovex/tgp/internal/config"
+	"github.com/geovex/tgp/internal/stats"
+)
+
+// server with config from text, config is not reloadable
+func testServer(t *testing.T, text string) *server {
+	t.Helper()
+	c, err := config.ReadConfig(writeConfig(t, text))
+	if err != nil {
+		t.Fatalf("config not read: %v", err)
+	}
+	return newServer(c, "")
+}
+
+const testServerConfig = `
+	listen_url = "127.0.0.1:0"
+	[users]
+	a = "dd000102030405060708090a0b0c0d0e0f"
+	b = "dd101112131415161718191a1b1c1d1e1f"
+`
+
+// connection with fixed remote address, records Close calls
+type testConn struct {
+	net.Conn
+	remote net.Addr
+	closed bool
+}
+
+func (c *testConn) RemoteAddr() net.Addr { return c.remote }
+func (c *testConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestParseStatsCmd(t *testing.T) {
+	for _, tc := range []struct {
+		line   string
+		cmd    string
+		args   []string
+		asJson bool
+	}{
+		{"stats", "stats", []string{}, false},
+		{"clients json", "clients", []string{}, true},
+		{"user json", "user", []string{"json"}, false},
+		{"user a json", "user", []string{"a"}, true},
+		{"reset user json", "reset", []string{"user", "json"}, false},
+		{"reset all json", "reset", []string{"all"}, true},
+		{"kick ip 10.0.0.1 json", "kick", []string{"ip", "10.0.0.1"}, true},
+	} {
+		cmd, args, asJson := parseStatsCmd(strings.Fields(tc.line))
+		if cmd != tc.cmd || !slices.Equal(args, tc.args) || asJson != tc.asJson {
+			t.Errorf("%q parsed as %q %q %v", tc.line, cmd, args, asJson)
+		}
+	}
+}
+
+func TestStatsCmd(t *testing.T) {
+	s := testServer(t, testServerConfig)
+	s.stats.AllocClient(nil, "test").SetAuthorized("a")
+	var b bytes.Buffer
+	s.statsCmd(&b, []string{"users"}, false)
+	if !strings.Contains(b.String(), "a: 1 connections") {
+		t.Errorf("unexpected users reply %q", b.String())
+	}
+	b.Reset()
+	s.statsCmd(&b, []string{"user", "a"}, true)
+	var reply userReply
+	if err := json.Unmarshal(b.Bytes(), &reply); err != nil || reply.Name != "a" || len(reply.Clients) != 1 {
+		t.Errorf("unexpected user reply %q", b.String())
+	}
+	b.Reset()
+	s.statsCmd(&b, []string{"unknown"}, true)
+	var errReply map[string]string
+	if err := json.Unmarshal(b.Bytes(), &errReply); err != nil || errReply["error"] == "" {
+		t.Errorf("unexpected error reply %q", b.String())
+	}
+	b.Reset()
+	s.statsCmd(&b, nil, false)
+	if b.Len() == 0 {
+		t.Errorf("empty stats reply")
+	}
+}
+
+func TestKickCmd(t *testing.T) {
+	s := testServer(t, testServerConfig)
+	conns := []*testConn{}
+	for i, name := range []string{"a", "a", "b"} {
+		conn := &testConn{remote: &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 1000}}
+		s.stats.AllocClient(conn, "test").SetAuthorized(name)
+		conns = append(conns, conn)
+	}
+	if kicked, err := s.kick([]string{"user", "a"}); err != nil || kicked != 2 || conns[2].closed {
+		t.Errorf("kick user: %d %v", kicked, err)
+	}
+	if kicked, err := s.kick([]string{"ip", "10.0.0.2"}); err != nil || kicked != 1 || !conns[2].closed {
+		t.Errorf("kick ip: %d %v", kicked, err)
+	}
+	for _, args := range [][]string{{"id", "x"}, {"ip", "x"}, {"name", "a"}, {"user"}} {
+		if _, err := s.kick(args); err == nil {
+			t.Errorf("invalid kick %q accepted", args)
+		}
+	}
+}
+
+func TestResetCmd(t *testing.T) {
+	s := testServer(t, testServerConfig)
+	s.statePath = filepath.Join(t.TempDir(), "state.json")
+	for _, name := range []string{"a", "b"} {
+		h := s.stats.AllocClient(nil, "test")
+		h.SetAuthorized(name)
+		h.CountUp(10, 0)
+		h.Close()
+	}
+	if err := s.reset([]string{"user", "a"}); err != nil {
+		t.Fatalf("reset user: %v", err)
+	}
+	totals := s.stats.UserTotals()
+	if totals["a"].Sessions != 0 || totals["b"].Sessions != 1 {
+		t.Errorf("unexpected totals after reset user %+v", totals)
+	}
+	loaded := stats.New()
+	if err := loaded.LoadState(s.statePath); err != nil || loaded.UserTotals()["b"].BytesUp != 10 {
+		t.Errorf("state not saved on reset: %v", err)
+	}
+	if err := s.reset([]string{"all"}); err != nil || s.stats.UserTotals()["b"].Sessions != 0 {
+		t.Errorf("reset all: %v", err)
+	}
+	if err := s.reset([]string{"user"}); err == nil {
+		t.Errorf("invalid reset accepted")
+	}
+}
+
+func TestStatsConnsConcurrent(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "stats.sock")
+	s := testServer(t, "stats_sock = \""+sock+"\"\n"+testServerConfig)
+	done := make(chan error)
+	go func() { done <- s.listenForStats() }()
+	defer func() {
+		s.closeListeners()
+		<-done
+	}()
+	dial := func() net.Conn {
+		for range 100 {
+			conn, err := net.Dial("unix", sock)
+			if err == nil {
+				return conn
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("stats socket not ready")
+		return nil
+	}
+	// interactive session is kept open
+	first := dial()
+	defer first.Close()
+	first.Write([]byte("help\n"))
+	bufio.NewReader(first).ReadString('\n')
+	second := dial()
+	defer second.Close()
+	second.Write([]byte("users\n"))
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(second).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "a:") {
+		t.Errorf("second stats client blocked: %q %v", line, err)
+	}
+}
+
+func TestUnbanCmd(t *testing.T) {
+	s := testServer(t, "ban_failures = 1\n"+testServerConfig)
+	ip := netip.MustParseAddr("10.0.0.1")
+	s.guard.Fail(ip)
+	if len(s.guard.Bans()) != 1 {
+		t.Fatalf("ip not banned")
+	}
+	var b bytes.Buffer
+	s.statsCmd(&b, []string{"unban", "10.0.0.1"}, false)
+	if b.String() != "unbanned\n" || len(s.guard.Bans()) != 0 {
+		t.Errorf("unexpected unban reply %q", b.String())
+	}
+	b.Reset()
+	s.statsCmd(&b, []string{"unban", "10.0.0.1"}, true)
+	if b.String() != `{"unbanned":false}`+"\n" {
+		t.Errorf("unexpected reply for ip without ban %q", b.String())
+	}
+	if _, err := s.unban([]string{"x"}); err == nil {
+		t.Errorf("invalid ip accepted")
+	}
+}
@@ -0,0 +1,118 @@
+// Access log writes one json record per line into size-rotated files
+package access_log
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+type Log struct {
+	lock     sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	closed   bool
+}
+
+var ErrClosed = errors.New("access log is closed")
+
+// Open log file for appending. When file grows over maxSize it's renamed to
+// path.1 (path.1 to path.2 and so on), only maxFiles old files are kept.
+// Zero maxSize disables rotation.
+func New(path string, maxSize int64, maxFiles int) (*Log, error) {
+	l := &Log{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return fmt.Errorf("can't open access log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("can't stat access log: %w", err)
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// name of rotated file with index
+func (l *Log) rotatedName(idx int) string {
+	return fmt.Sprintf("%s.%d", l.path, idx)
+}
+
+func (l *Log) rotate() error {
+	l.file.Close()
+	l.file = nil
+	if l.maxFiles > 0 {
+		os.Remove(l.rotatedName(l.maxFiles))
+		for i := l.maxFiles - 1; i > 0; i-- {
+			os.Rename(l.rotatedName(i), l.rotatedName(i+1))
+		}
+		err := os.Rename(l.path, l.rotatedName(1))
+		if err != nil {
+			return fmt.Errorf("can't rotate access log: %w", err)
+		}
+	} else {
+		os.Remove(l.path)
+	}
+	return l.open()
+}
+
+// write record as json line
+func (l *Log) Write(record any) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	if l.file == nil {
+		// previous rotation failed
+		err = l.open()
+		if err != nil {
+			return err
+		}
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(data)) > l.maxSize {
+		err = l.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	return err
+}
+
+func (l *Log) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.closed = true
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
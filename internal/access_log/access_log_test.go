@@ -0,0 +1,75 @@
+package access_log
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type record struct {
+	N int `json:"n"`
+}
+
+func countLines(t *testing.T, path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r record
+		err = json.Unmarshal(scanner.Bytes(), &r)
+		if err != nil {
+			t.Errorf("invalid record %q: %v", scanner.Text(), err)
+		}
+		lines++
+	}
+	return lines
+}
+
+func TestRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.jsonl")
+	// each record is 8 bytes, so 2 records fit into file
+	l, err := New(path, 20, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		err = l.Write(record{N: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+	if n := countLines(t, path); n != 1 {
+		t.Errorf("expected 1 record in current file, found %d", n)
+	}
+	if n := countLines(t, path+".1"); n != 2 {
+		t.Errorf("expected 2 records in first rotated file, found %d", n)
+	}
+	if n := countLines(t, path+".2"); n != 2 {
+		t.Errorf("expected 2 records in second rotated file, found %d", n)
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Errorf("too many rotated files kept")
+	}
+}
+
+func TestAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.jsonl")
+	for i := 0; i < 2; i++ {
+		l, err := New(path, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Write(record{N: i})
+		l.Close()
+	}
+	if n := countLines(t, path); n != 2 {
+		t.Errorf("expected 2 records, found %d", n)
+	}
+}
@@ -2,8 +2,12 @@ package config
 
 import (
 	"fmt"
+	"log/slog"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/geovex/tgp/internal/ip_guard"
+	"github.com/geovex/tgp/internal/stats"
 )
 
 var defaultConfigData = `
@@ -15,7 +19,7 @@ host = "google.com:443"
 socks5_user = "test"
 socks5_pass = ""
 #obfuscate = true
-allowipv6 = true
+ipv6 = true
 [users]
 1 = "dd000102030405060708090a0b0c0d0e0f"
 [users.2] 
@@ -31,42 +35,240 @@ type parsedConfig struct {
 	Host             *string
 	Ignore_timestamp *bool
 	Stats_Sock       *string
+	Metrics_listen   *string
 	Obfuscate        *bool
 	Adtag            *string
 	Socks5           *string
 	Socks5_user      *string
 	Socks5_pass      *string
 	Ipv6             *bool
-	Users            *map[string]toml.Primitive
+	Drain_timeout    *time.Duration
+	Reload_terminate *bool
+	// timeouts, 0 disables timeout
+	Handshake_timeout  *time.Duration
+	Dc_connect_timeout *time.Duration
+	Idle_timeout       *time.Duration
+	// per ip limits
+	Ip_max_connections       *int
+	Ip_handshakes_per_minute *int
+	Ban_failures             *int
+	Ban_window               *time.Duration
+	Ban_ttl                  *time.Duration
+	Ban_action               *string
+	Log_level                *string
+	Log_format               *string
+	Access_log               *string
+	Access_log_max_size      *Size
+	Access_log_max_files     *int
+	State_file               *string
+	State_flush_interval     *time.Duration
+	Quota                    *Size
+	Quota_period             *string
+	Quota_action             *string
+	Rate_up                  *Size
+	Rate_down                *Size
+	Global_rate_up           *Size
+	Global_rate_down         *Size
+	Max_connections          *int
+	Max_ips                  *int
+	Users                    *map[string]toml.Primitive
+	Users_file               *string
+	Profiles                 *map[string]toml.Primitive
+	// credentials can be read from files
+	Secret_file      *string
+	Adtag_file       *string
+	Socks5_pass_file *string
 }
 
 // TODO use same parsing for default user and user
 type parsedUserPrimitive struct {
+	Secret          string
+	Obfuscate       *bool
+	Adtag           *string
+	Socks5          *string
+	Socks5_user     *string
+	Socks5_pass     *string
+	Quota           *Size
+	Quota_period    *string
+	Rate_up         *Size
+	Rate_down       *Size
+	Max_connections *int
+	Max_ips         *int
+	Expires         *time.Time
+	Disabled        *bool
+	Allow_ips       []string
+	Allow_dcs       []int16
+	Profile         *string
+	Secrets         []parsedSecret
+	// credentials can be read from files
+	Secret_file      *string
+	Adtag_file       *string
+	Socks5_pass_file *string
+}
+
+// entry of user's secrets list
+type parsedSecret struct {
 	Secret      string
-	Obfuscate   *bool
-	Adtag       *string
-	Socks5      *string
-	Socks5_user *string
-	Socks5_pass *string
+	Secret_file *string
+	Not_after   *time.Time
+	Label       *string
+}
+
+// listener settings from listen_url entry
+type Listener struct {
+	// tcp address, empty for unix socket listeners
+	Url string
+	// unix socket path
+	Unix string
+	// users allowed on this listener, empty means all users
+	Users []string
+	// fallback host override, empty string disables fallback
+	Host *string
+	// expect PROXY protocol header before client data
+	ProxyProtocol bool
+	NoDelay       bool
+	// tcp keepalive period, 0 for system default, negative to disable
+	KeepAlive time.Duration
+}
+
+// listener address for logs
+func (l *Listener) String() string {
+	if l.Unix != "" {
+		return "unix:" + l.Unix
+	}
+	return l.Url
+}
+
+type parsedListener struct {
+	Url            *string
+	Unix           *string
+	Users          []string
+	Host           *string
+	Proxy_protocol *bool
+	Tcp_nodelay    *bool
+	Tcp_keepalive  *time.Duration
 }
 
 type Config struct {
-	listen_Urls     []string
+	listeners       []Listener
 	allowIPv6       bool
 	secret          *string
 	host            *string
 	ignoreTimestamp bool
 	stats_sock      *string
+	metricsListen   string
 	obfuscate       bool
 	AdTag           *string
 	socks5          *string
 	socks5_user     *string
 	socks5_pass     *string
+	drainTimeout    time.Duration
+	reloadTerminate bool
+	timeouts        Timeouts
+	ipLimits        ip_guard.Limits
+	banFallback     bool
+	logLevel        slog.Level
+	logJson         bool
+	accessLog       AccessLog
+	state           StateFile
+	quota           Size
+	quotaPeriod     stats.QuotaPeriod
+	quotaFallback   bool
+	rateUp          Size
+	rateDown        Size
+	globalRate      Rates
+	maxConnections  int
+	maxIPs          int
 	users           *userDB
+	// shared user settings by profile name
+	profiles map[string]*User
+	// users from main config, users file entries are added to them
+	inlineUsers    *userDB
+	usersFile      string
+	usersFileStamp fileStamp
+	// problems of skipped users file entries
+	userErrors []error
+}
+
+// time to wait for active sessions to finish on shutdown
+const defaultDrainTimeout = 10 * time.Second
+
+const (
+	defaultBanWindow = time.Minute
+	defaultBanTTL    = 10 * time.Minute
+)
+
+const (
+	defaultHandshakeTimeout = 10 * time.Second
+	defaultDcConnectTimeout = 10 * time.Second
+	defaultIdleTimeout      = 5 * time.Minute
+)
+
+// Session records log. Empty path disables log.
+type AccessLog struct {
+	Path string
+	// file is rotated after this size, 0 disables rotation
+	MaxSize  Size
+	MaxFiles int
+}
+
+// file with cumulative per-user accounting
+type StateFile struct {
+	// empty if state is not persisted
+	Path          string
+	FlushInterval time.Duration
+}
+
+const defaultStateFlushInterval = time.Minute
+
+const (
+	defaultAccessLogMaxSize  = 100 << 20
+	defaultAccessLogMaxFiles = 5
+)
+
+// Client session timeouts. Zero value means no timeout.
+type Timeouts struct {
+	// time for client to complete handshake
+	Handshake time.Duration
+	// time to connect (and login) to DC or middle proxy
+	DcConnect time.Duration
+	// session is closed if both sides are silent for this time
+	Idle time.Duration
 }
 
 func (c *Config) GetListenUrl() []string {
-	return c.listen_Urls
+	urls := make([]string, 0, len(c.listeners))
+	for _, l := range c.listeners {
+		if l.Url != "" {
+			urls = append(urls, l.Url)
+		}
+	}
+	return urls
+}
+
+func (c *Config) GetListeners() []Listener {
+	return c.listeners
+}
+
+// find listener by it's address
+func (c *Config) GetListener(addr string) *Listener {
+	for i := range c.listeners {
+		if c.listeners[i].String() == addr {
+			return &c.listeners[i]
+		}
+	}
+	return nil
+}
+
+func (c *Config) HasUser(user string) bool {
+	_, ok := c.users.Users[user]
+	return ok
+}
+
+// check if user exists and may connect at time now
+func (c *Config) IsUserActive(user string, now time.Time) bool {
+	u, err := c.GetUser(user)
+	return err == nil && u.Active(now)
 }
 
 func (c *Config) GetAllowIPv6() bool {
@@ -79,8 +281,15 @@ func (c *Config) GetUser(user string) (u User, err error) {
 	if !ok {
 		return u, fmt.Errorf("user %s not found", user)
 	}
-	// process property inheritance
+	return c.resolveUser(userData), nil
+}
+
+// process property inheritance: user, profile, root section
+func (c *Config) resolveUser(userData *User) (u User) {
 	u = *userData
+	if profile, ok := c.profiles[u.Profile]; ok {
+		u.inherit(profile)
+	}
 	if u.Obfuscate == nil {
 		u.Obfuscate = &c.obfuscate
 	}
@@ -100,6 +309,24 @@ func (c *Config) GetUser(user string) (u User, err error) {
 	if u.Socks5_pass == nil {
 		u.Socks5_pass = c.socks5_pass
 	}
+	if u.Quota == nil {
+		u.Quota = &c.quota
+	}
+	if u.QuotaPeriod == nil {
+		u.QuotaPeriod = &c.quotaPeriod
+	}
+	if u.RateUp == nil {
+		u.RateUp = &c.rateUp
+	}
+	if u.RateDown == nil {
+		u.RateDown = &c.rateDown
+	}
+	if u.MaxConnections == nil {
+		u.MaxConnections = &c.maxConnections
+	}
+	if u.MaxIPs == nil {
+		u.MaxIPs = &c.maxIPs
+	}
 	return
 }
 
@@ -140,3 +367,91 @@ func (c *Config) GetIgnoreTimestamp() bool {
 func (c *Config) GetStatsSock() *string {
 	return c.stats_sock
 }
+
+// address of http listener for prometheus metrics, empty if disabled
+func (c *Config) GetMetricsListen() string {
+	return c.metricsListen
+}
+
+func (c *Config) GetDrainTimeout() time.Duration {
+	return c.drainTimeout
+}
+
+func (c *Config) GetTimeouts() Timeouts {
+	return c.timeouts
+}
+
+func (c *Config) GetIPLimits() ip_guard.Limits {
+	return c.ipLimits
+}
+
+// whether banned clients are redirected to fallback host instead of closing
+func (c *Config) GetBanFallback() bool {
+	return c.banFallback
+}
+
+func (c *Config) GetAccessLog() AccessLog {
+	return c.accessLog
+}
+
+func (c *Config) GetStateFile() StateFile {
+	return c.state
+}
+
+// Traffic rates in bytes per second, 0 is unlimited
+type Rates struct {
+	Up, Down Size
+}
+
+// aggregate rate limit of all sessions
+func (c *Config) GetGlobalRate() Rates {
+	return c.globalRate
+}
+
+// redirect users over quota to fallback host instead of closing connection
+func (c *Config) GetQuotaFallback() bool {
+	return c.quotaFallback
+}
+
+// path of users file, empty if users are only in main config
+func (c *Config) GetUsersFile() string {
+	return c.usersFile
+}
+
+// problems of users file entries skipped on load
+func (c *Config) GetUserErrors() []error {
+	return c.userErrors
+}
+
+// check if users file was changed or removed since it was read
+func (c *Config) UsersFileChanged() bool {
+	if c.usersFile == "" {
+		return false
+	}
+	stamp, err := statFile(c.usersFile)
+	return err != nil || !stamp.modTime.Equal(c.usersFileStamp.modTime) || stamp.size != c.usersFileStamp.size
+}
+
+// copy of config with users file read again, other settings are kept
+func (c *Config) ReloadUsers() (*Config, error) {
+	nc := *c
+	err := nc.loadUsersFile()
+	if err != nil {
+		return nil, err
+	}
+	return &nc, nil
+}
+
+func (c *Config) GetLogLevel() slog.Level {
+	return c.logLevel
+}
+
+// whether logs are written as json instead of text
+func (c *Config) GetLogJson() bool {
+	return c.logJson
+}
+
+// whether sessions of removed or changed users are closed on config reload
+func (c *Config) GetReloadTerminate() bool {
+	return c.reloadTerminate
+}
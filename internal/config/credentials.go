@@ -0,0 +1,98 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// replace ${VAR} references with values of environment variables. Unset
+// variable is an error, so misspelled name doesn't turn into empty password.
+func expandEnv(name, value string) (string, error) {
+	var err error
+	expanded := envRef.ReplaceAllStringFunc(value, func(ref string) string {
+		varName := envRef.FindStringSubmatch(ref)[1]
+		v, ok := os.LookupEnv(varName)
+		if !ok && err == nil {
+			err = fmt.Errorf("%s: environment variable %s is not set", name, varName)
+		}
+		return v
+	})
+	return expanded, err
+}
+
+// credential given by value with ${VAR} references or by file (name_file
+// option). File content is used without surrounding whitespace.
+func credential(name string, value, file *string) (*string, error) {
+	if file != nil && *file != "" {
+		if value != nil {
+			return nil, fmt.Errorf("%s and %s_file are mutually exclusive", name, name)
+		}
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			return nil, fmt.Errorf("can't read %s_file: %w", name, err)
+		}
+		v := strings.TrimSpace(string(data))
+		return &v, nil
+	}
+	if value == nil {
+		return nil, nil
+	}
+	v, err := expandEnv(name, *value)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// resolve secret, adtag and socks5 credentials of root section
+func (p *parsedConfig) resolveCredentials() (err error) {
+	if p.Secret, err = credential("secret", p.Secret, p.Secret_file); err != nil {
+		return err
+	}
+	if p.Adtag, err = credential("adtag", p.Adtag, p.Adtag_file); err != nil {
+		return err
+	}
+	if p.Socks5_user, err = credential("socks5_user", p.Socks5_user, nil); err != nil {
+		return err
+	}
+	p.Socks5_pass, err = credential("socks5_pass", p.Socks5_pass, p.Socks5_pass_file)
+	return err
+}
+
+// user secret is empty string if it's not set
+func secretCredential(secret string, file *string) (string, error) {
+	var value *string
+	if secret != "" {
+		value = &secret
+	}
+	value, err := credential("secret", value, file)
+	if err != nil || value == nil {
+		return "", err
+	}
+	return *value, nil
+}
+
+// resolve secrets, adtag and socks5 credentials of user section
+func (p *parsedUserPrimitive) resolveCredentials() (err error) {
+	if p.Secret, err = secretCredential(p.Secret, p.Secret_file); err != nil {
+		return err
+	}
+	for i := range p.Secrets {
+		s := &p.Secrets[i]
+		if s.Secret, err = secretCredential(s.Secret, s.Secret_file); err != nil {
+			return fmt.Errorf("secrets entry %d: %w", i+1, err)
+		}
+	}
+	if p.Adtag, err = credential("adtag", p.Adtag, p.Adtag_file); err != nil {
+		return err
+	}
+	if p.Socks5_user, err = credential("socks5_user", p.Socks5_user, nil); err != nil {
+		return err
+	}
+	p.Socks5_pass, err = credential("socks5_pass", p.Socks5_pass, p.Socks5_pass_file)
+	return err
+}
@@ -0,0 +1,194 @@
+package config
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// placeholder of credential values in effective config
+const redacted = "<redacted>"
+
+// settings after defaults and inheritance are applied, in config file syntax
+type effectiveConfig struct {
+	Listen_url               []effectiveListener      `toml:"listen_url"`
+	Ipv6                     bool                     `toml:"ipv6"`
+	Ignore_timestamp         bool                     `toml:"ignore_timestamp"`
+	Stats_sock               string                   `toml:"stats_sock,omitempty"`
+	Metrics_listen           string                   `toml:"metrics_listen,omitempty"`
+	Drain_timeout            string                   `toml:"drain_timeout"`
+	Reload_terminate         bool                     `toml:"reload_terminate"`
+	Handshake_timeout        string                   `toml:"handshake_timeout"`
+	Dc_connect_timeout       string                   `toml:"dc_connect_timeout"`
+	Idle_timeout             string                   `toml:"idle_timeout"`
+	Ip_max_connections       int                      `toml:"ip_max_connections"`
+	Ip_handshakes_per_minute int                      `toml:"ip_handshakes_per_minute"`
+	Ban_failures             int                      `toml:"ban_failures"`
+	Ban_window               string                   `toml:"ban_window"`
+	Ban_ttl                  string                   `toml:"ban_ttl"`
+	Ban_action               string                   `toml:"ban_action"`
+	Log_level                string                   `toml:"log_level"`
+	Log_format               string                   `toml:"log_format"`
+	Access_log               string                   `toml:"access_log,omitempty"`
+	State_file               string                   `toml:"state_file,omitempty"`
+	Quota_action             string                   `toml:"quota_action"`
+	Global_rate_up           string                   `toml:"global_rate_up"`
+	Global_rate_down         string                   `toml:"global_rate_down"`
+	Host                     string                   `toml:"host,omitempty"`
+	Socks5                   string                   `toml:"socks5,omitempty"`
+	Socks5_user              string                   `toml:"socks5_user,omitempty"`
+	Socks5_pass              string                   `toml:"socks5_pass,omitempty"`
+	Users_file               string                   `toml:"users_file,omitempty"`
+	Users                    map[string]effectiveUser `toml:"users"`
+}
+
+type effectiveListener struct {
+	Url            string   `toml:"url,omitempty"`
+	Unix           string   `toml:"unix,omitempty"`
+	Users          []string `toml:"users,omitempty"`
+	Host           *string  `toml:"host,omitempty"`
+	Proxy_protocol bool     `toml:"proxy_protocol"`
+	Tcp_nodelay    bool     `toml:"tcp_nodelay"`
+	Tcp_keepalive  string   `toml:"tcp_keepalive"`
+}
+
+type effectiveUser struct {
+	Secret          string            `toml:"secret,omitempty"`
+	Secrets         []effectiveSecret `toml:"secrets,omitempty"`
+	Profile         string            `toml:"profile,omitempty"`
+	Obfuscate       bool              `toml:"obfuscate"`
+	Adtag           string            `toml:"adtag,omitempty"`
+	Socks5          string            `toml:"socks5,omitempty"`
+	Socks5_user     string            `toml:"socks5_user,omitempty"`
+	Socks5_pass     string            `toml:"socks5_pass,omitempty"`
+	Quota           string            `toml:"quota"`
+	Quota_period    string            `toml:"quota_period"`
+	Rate_up         string            `toml:"rate_up"`
+	Rate_down       string            `toml:"rate_down"`
+	Max_connections int               `toml:"max_connections"`
+	Max_ips         int               `toml:"max_ips"`
+	Expires         string            `toml:"expires,omitempty"`
+	Disabled        bool              `toml:"disabled,omitempty"`
+	Allow_ips       []string          `toml:"allow_ips,omitempty"`
+	Allow_dcs       []int16           `toml:"allow_dcs,omitempty"`
+}
+
+type effectiveSecret struct {
+	Secret    string `toml:"secret"`
+	Label     string `toml:"label"`
+	Not_after string `toml:"not_after,omitempty"`
+}
+
+// credential value hidden in output, empty value is kept to show it's unset
+func redact(v *string) string {
+	if v == nil || *v == "" {
+		return ""
+	}
+	return redacted
+}
+
+func optString(v *string) string {
+	if v == nil {
+		return ""
+	}
+	return *v
+}
+
+// write effective config as toml, credentials are redacted
+func (c *Config) WriteEffective(w io.Writer) error {
+	e := effectiveConfig{
+		Ipv6:                     c.allowIPv6,
+		Ignore_timestamp:         c.ignoreTimestamp,
+		Stats_sock:               optString(c.stats_sock),
+		Metrics_listen:           c.metricsListen,
+		Drain_timeout:            c.drainTimeout.String(),
+		Reload_terminate:         c.reloadTerminate,
+		Handshake_timeout:        c.timeouts.Handshake.String(),
+		Dc_connect_timeout:       c.timeouts.DcConnect.String(),
+		Idle_timeout:             c.timeouts.Idle.String(),
+		Ip_max_connections:       c.ipLimits.MaxConnections,
+		Ip_handshakes_per_minute: c.ipLimits.HandshakesPerMinute,
+		Ban_failures:             c.ipLimits.BanFailures,
+		Ban_window:               c.ipLimits.BanWindow.String(),
+		Ban_ttl:                  c.ipLimits.BanTTL.String(),
+		Ban_action:               "close",
+		Log_level:                strings.ToLower(c.logLevel.String()),
+		Log_format:               "text",
+		Access_log:               c.accessLog.Path,
+		State_file:               c.state.Path,
+		Quota_action:             "close",
+		Global_rate_up:           c.globalRate.Up.String(),
+		Global_rate_down:         c.globalRate.Down.String(),
+		Host:                     optString(c.host),
+		Socks5:                   optString(c.socks5),
+		Socks5_user:              redact(c.socks5_user),
+		Socks5_pass:              redact(c.socks5_pass),
+		Users_file:               c.usersFile,
+		Users:                    map[string]effectiveUser{},
+	}
+	if c.banFallback {
+		e.Ban_action = "fallback"
+	}
+	if c.logJson {
+		e.Log_format = "json"
+	}
+	if c.quotaFallback {
+		e.Quota_action = "fallback"
+	}
+	for _, l := range c.listeners {
+		e.Listen_url = append(e.Listen_url, effectiveListener{
+			Url:            l.Url,
+			Unix:           l.Unix,
+			Users:          l.Users,
+			Host:           l.Host,
+			Proxy_protocol: l.ProxyProtocol,
+			Tcp_nodelay:    l.NoDelay,
+			Tcp_keepalive:  l.KeepAlive.String(),
+		})
+	}
+	for _, name := range slices.Sorted(c.IterateUsers()) {
+		u, err := c.GetUser(name)
+		if err != nil {
+			return err
+		}
+		secret, err := c.GetUserSecret(name)
+		if err != nil {
+			return err
+		}
+		eu := effectiveUser{
+			Secret:          redact(&secret),
+			Profile:         u.Profile,
+			Obfuscate:       *u.Obfuscate,
+			Adtag:           redact(u.AdTag),
+			Socks5:          optString(u.Socks5),
+			Socks5_user:     redact(u.Socks5_user),
+			Socks5_pass:     redact(u.Socks5_pass),
+			Quota:           u.Quota.String(),
+			Quota_period:    string(*u.QuotaPeriod),
+			Rate_up:         u.RateUp.String(),
+			Rate_down:       u.RateDown.String(),
+			Max_connections: *u.MaxConnections,
+			Max_ips:         *u.MaxIPs,
+			Disabled:        u.Disabled,
+			Allow_dcs:       u.AllowDCs,
+		}
+		if u.Expires != nil {
+			eu.Expires = u.Expires.UTC().Format(time.RFC3339)
+		}
+		for _, s := range u.Secrets {
+			es := effectiveSecret{Secret: redact(&s.Secret), Label: s.Label}
+			if s.NotAfter != nil {
+				es.Not_after = s.NotAfter.UTC().Format(time.RFC3339)
+			}
+			eu.Secrets = append(eu.Secrets, es)
+		}
+		for _, prefix := range u.AllowIPs {
+			eu.Allow_ips = append(eu.Allow_ips, prefix.String())
+		}
+		e.Users[name] = eu
+	}
+	return toml.NewEncoder(w).Encode(e)
+}
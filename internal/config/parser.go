@@ -2,9 +2,19 @@ package config
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/geovex/tgp/internal/ip_guard"
+	"github.com/geovex/tgp/internal/stats"
 	"github.com/geovex/tgp/internal/tgcrypt_encryption"
 )
 
@@ -34,38 +44,167 @@ func DefaultConfig() *Config {
 	return result
 }
 
-func configFromParsed(parsed *parsedConfig, md *toml.MetaData) (*Config, error) {
-	c, err := configFromParsedUnchecked(parsed, md)
+// Check config file and return all found problems. Empty result means config
+// is valid.
+func CheckConfig(path string) []error {
+	var c parsedConfig
+	md, err := toml.DecodeFile(path, &c)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate unchecked config: %w", err)
+		return []error{fmt.Errorf("failed to parse config file: %w", err)}
+	}
+	result, errs := configFromParsedUnchecked(&c, &md)
+	errs = append(errs, checkConfig(result, &md)...)
+	return append(errs, result.userErrors...)
+}
+
+func configFromParsed(parsed *parsedConfig, md *toml.MetaData) (*Config, error) {
+	c, errs := configFromParsedUnchecked(parsed, md)
+	errs = append(errs, checkConfig(c, md)...)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return c, nil
+}
+
+// validate config and collect all problems
+func checkConfig(c *Config, md *toml.MetaData) (errs []error) {
+	for _, key := range md.Undecoded() {
+		errs = append(errs, fmt.Errorf("unknown option %s", key))
 	}
-	for name := range c.IterateUsers() {
+	for _, l := range c.listeners {
+		if l.Url != "" {
+			if err := checkHostPort(l.Url); err != nil {
+				errs = append(errs, fmt.Errorf("listener %s: invalid address: %w", l.String(), err))
+			}
+		}
+		if l.Host != nil && *l.Host != "" {
+			if err := checkHostPort(*l.Host); err != nil {
+				errs = append(errs, fmt.Errorf("listener %s: invalid host: %w", l.String(), err))
+			}
+		}
+		for _, name := range l.Users {
+			if _, ok := c.users.Users[name]; !ok {
+				errs = append(errs, fmt.Errorf("listener %s: unknown user %s", l.String(), name))
+			}
+		}
+	}
+	if c.host != nil && *c.host != "" {
+		if err := checkHostPort(*c.host); err != nil {
+			errs = append(errs, fmt.Errorf("invalid host: %w", err))
+		}
+	}
+	// users with same key can't be told apart on handshake. Users file
+	// entries are checked when file is loaded, invalid ones are skipped.
+	keyOwners := map[string]string{}
+	names := slices.Sorted(maps.Keys(c.inlineUsers.Users))
+	for _, name := range names {
 		userData, _ := c.GetUser(name)
-		err = checkUser(&userData)
+		err := checkUser(&userData)
+		if err == nil {
+			err = checkUserSocks(c.users.Users[name])
+		}
+		if err == nil {
+			err = c.checkProfile(&userData)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid config for user %s: %w", name, err))
+		}
+		err = checkSecrets(&userData)
 		if err != nil {
-			return nil, fmt.Errorf("invalid config for user %s: %w", name, err)
+			errs = append(errs, fmt.Errorf("invalid secret for user %s: %w", name, err))
+			continue
+		}
+		for _, s := range userData.AllSecrets() {
+			secret, _ := tgcrypt_encryption.NewSecretHex(s.Secret)
+			key := string(secret.RawSecret)
+			if owner, ok := keyOwners[key]; ok {
+				errs = append(errs, fmt.Errorf("users %s and %s have same secret", owner, name))
+			} else {
+				keyOwners[key] = name
+			}
 		}
 	}
-	return c, nil
+	return
+}
+
+// check that user's profile exists
+func (c *Config) checkProfile(u *User) error {
+	if _, ok := c.profiles[u.Profile]; u.Profile != "" && !ok {
+		return fmt.Errorf("unknown profile %s", u.Profile)
+	}
+	return nil
 }
 
-func configFromParsedUnchecked(parsed *parsedConfig, md *toml.MetaData) (*Config, error) {
+// check socks5 address set in user section, inherited one is checked with
+// root section
+func checkUserSocks(u *User) error {
+	if u.Socks5 != nil && *u.Socks5 != "" {
+		if err := checkHostPort(*u.Socks5); err != nil {
+			return fmt.Errorf("socks5 must be host:port: %w", err)
+		}
+	}
+	return nil
+}
+
+// check that address is host:port with numeric port
+func checkHostPort(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" && port == "" {
+		return fmt.Errorf("empty address")
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// build config from parsed file. Problems are collected and invalid options
+// are replaced with defaults, so config can be checked further.
+func configFromParsedUnchecked(parsed *parsedConfig, md *toml.MetaData) (*Config, []error) {
+	var errs []error
+	fail := func(err error) {
+		errs = append(errs, err)
+	}
+	if err := parsed.resolveCredentials(); err != nil {
+		fail(err)
+	}
 	//parse listen url
-	var listenUrls []string
-	if md.Type("listen_url") == "String" {
+	var listeners []Listener
+	switch md.Type("listen_url") {
+	case "String":
 		var url string
 		err := md.PrimitiveDecode(parsed.Listen_Url, &url)
 		if err != nil {
-			return nil, fmt.Errorf("failed to decode listen_url: %w", err)
+			fail(fmt.Errorf("failed to decode listen_url: %w", err))
+		} else {
+			listeners = []Listener{{Url: url, NoDelay: true}}
+		}
+	case "Hash":
+		l, err := parseListener(md, parsed.Listen_Url)
+		if err != nil {
+			fail(fmt.Errorf("failed to decode listen_url: %w", err))
+		} else {
+			listeners = []Listener{l}
 		}
-		listenUrls = []string{url}
-	} else if md.Type("listen_url") == "Array" {
-		err := md.PrimitiveDecode(parsed.Listen_Url, &listenUrls)
+	case "Array", "ArrayHash":
+		var entries []toml.Primitive
+		err := md.PrimitiveDecode(parsed.Listen_Url, &entries)
 		if err != nil {
-			return nil, fmt.Errorf("failed to decode listen_url: %w", err)
+			fail(fmt.Errorf("failed to decode listen_url: %w", err))
 		}
-	} else {
-		return nil, fmt.Errorf("listen_url must be string or array")
+		for i, entry := range entries {
+			l, err := parseListener(md, entry)
+			if err != nil {
+				fail(fmt.Errorf("failed to decode listen_url %d: %w", i, err))
+				continue
+			}
+			listeners = append(listeners, l)
+		}
+	default:
+		fail(fmt.Errorf("listen_url must be string, table or array"))
 	}
 	//check for ipv6
 	var allowIPv6 bool
@@ -86,10 +225,146 @@ func configFromParsedUnchecked(parsed *parsedConfig, md *toml.MetaData) (*Config
 	} else {
 		ignoreTimestamp = *parsed.Ignore_timestamp
 	}
-	var users *userDB
+	drainTimeout, err := parseTimeout("drain_timeout", parsed.Drain_timeout, defaultDrainTimeout)
+	if err != nil {
+		fail(err)
+	}
+	var timeouts Timeouts
+	timeouts.Handshake, err = parseTimeout("handshake_timeout", parsed.Handshake_timeout, defaultHandshakeTimeout)
+	if err != nil {
+		fail(err)
+	}
+	timeouts.DcConnect, err = parseTimeout("dc_connect_timeout", parsed.Dc_connect_timeout, defaultDcConnectTimeout)
+	if err != nil {
+		fail(err)
+	}
+	timeouts.Idle, err = parseTimeout("idle_timeout", parsed.Idle_timeout, defaultIdleTimeout)
+	if err != nil {
+		fail(err)
+	}
+	ipLimits, banFallback, limitErrs := parseIPLimits(parsed)
+	errs = append(errs, limitErrs...)
+	var logLevel slog.Level
+	if parsed.Log_level != nil {
+		err = logLevel.UnmarshalText([]byte(*parsed.Log_level))
+		if err != nil {
+			fail(fmt.Errorf("invalid log_level: %w", err))
+		}
+	}
+	var logJson bool
+	if parsed.Log_format != nil {
+		switch *parsed.Log_format {
+		case "text":
+			logJson = false
+		case "json":
+			logJson = true
+		default:
+			fail(fmt.Errorf("log_format must be text or json"))
+		}
+	}
+	accessLog := AccessLog{
+		MaxSize:  defaultAccessLogMaxSize,
+		MaxFiles: defaultAccessLogMaxFiles,
+	}
+	if parsed.Access_log != nil {
+		accessLog.Path = *parsed.Access_log
+	}
+	if parsed.Access_log_max_size != nil {
+		accessLog.MaxSize = *parsed.Access_log_max_size
+	}
+	if parsed.Access_log_max_files != nil {
+		if *parsed.Access_log_max_files < 0 {
+			fail(fmt.Errorf("access_log_max_files must not be negative"))
+		} else {
+			accessLog.MaxFiles = *parsed.Access_log_max_files
+		}
+	}
+	state := StateFile{FlushInterval: defaultStateFlushInterval}
+	if parsed.State_file != nil {
+		state.Path = *parsed.State_file
+	}
+	if parsed.State_flush_interval != nil {
+		if *parsed.State_flush_interval <= 0 {
+			fail(fmt.Errorf("state_flush_interval must be positive"))
+		} else {
+			state.FlushInterval = *parsed.State_flush_interval
+		}
+	}
+	quotaPeriod := stats.QuotaMonthly
+	if parsed.Quota_period != nil {
+		period, err := parseQuotaPeriod(*parsed.Quota_period)
+		if err != nil {
+			fail(err)
+		} else {
+			quotaPeriod = period
+		}
+	}
+	quota := optSize(parsed.Quota)
+	var quotaFallback bool
+	if parsed.Quota_action != nil {
+		switch *parsed.Quota_action {
+		case "close":
+			quotaFallback = false
+		case "fallback":
+			quotaFallback = true
+		default:
+			fail(fmt.Errorf("quota_action must be close or fallback"))
+		}
+	}
+	rateUp, rateDown := optSize(parsed.Rate_up), optSize(parsed.Rate_down)
+	globalRate := Rates{
+		Up:   optSize(parsed.Global_rate_up),
+		Down: optSize(parsed.Global_rate_down),
+	}
+	if rateUp < 0 || rateDown < 0 || globalRate.Up < 0 || globalRate.Down < 0 {
+		fail(fmt.Errorf("rate limits must not be negative"))
+	}
+	var maxConnections, maxIPs int
+	if parsed.Max_connections != nil {
+		maxConnections = *parsed.Max_connections
+	}
+	if parsed.Max_ips != nil {
+		maxIPs = *parsed.Max_ips
+	}
+	if maxConnections < 0 || maxIPs < 0 {
+		fail(fmt.Errorf("max_connections and max_ips must not be negative"))
+	}
+	var metricsListen string
+	if parsed.Metrics_listen != nil && *parsed.Metrics_listen != "" {
+		err := checkHostPort(*parsed.Metrics_listen)
+		if err != nil {
+			fail(fmt.Errorf("metrics_listen must be host:port: %w", err))
+		} else {
+			metricsListen = *parsed.Metrics_listen
+		}
+	}
+	if parsed.Socks5 != nil && *parsed.Socks5 != "" {
+		if err := checkHostPort(*parsed.Socks5); err != nil {
+			fail(fmt.Errorf("socks5 must be host:port: %w", err))
+		}
+	}
+	var reloadTerminate bool
+	if parsed.Reload_terminate == nil {
+		reloadTerminate = false
+	} else {
+		reloadTerminate = *parsed.Reload_terminate
+	}
+	profiles := map[string]*User{}
+	if parsed.Profiles != nil {
+		// sorted, so problems are reported in stable order
+		for _, name := range slices.Sorted(maps.Keys(*parsed.Profiles)) {
+			p, err := parseProfile(md, name, (*parsed.Profiles)[name])
+			if err != nil {
+				fail(fmt.Errorf("profile %s: %w", name, err))
+				continue
+			}
+			profiles[name] = p
+		}
+	}
+	users := NewUsers()
 	if parsed.Users != nil && parsed.Secret == nil {
-		users = NewUsers()
-		for name, data := range *parsed.Users {
+		for _, name := range slices.Sorted(maps.Keys(*parsed.Users)) {
+			data := (*parsed.Users)[name]
 			var u User
 			// user defined by it's secret
 			userRecordType := md.Type("users", name)
@@ -97,60 +372,323 @@ func configFromParsedUnchecked(parsed *parsedConfig, md *toml.MetaData) (*Config
 			case "String":
 				var secret string
 				err := md.PrimitiveDecode(data, &secret)
+				if err == nil {
+					secret, err = expandEnv("secret", secret)
+				}
 				if err != nil {
-					return nil, err
+					fail(fmt.Errorf("user %s: %w", name, err))
+					continue
 				}
+				// other settings are inherited from root section
 				u = User{
-					Name:        name,
-					Secret:      secret,
-					Obfuscate:   parsed.Obfuscate,
-					AdTag:       parsed.Adtag,
-					Socks5:      parsed.Socks5,
-					Socks5_user: parsed.Socks5_user,
-					Socks5_pass: parsed.Socks5_pass,
+					Name:   name,
+					Secret: secret,
 				}
 			case "Hash": // user fully defined
 				var pu parsedUserPrimitive
 				err := md.PrimitiveDecode(data, &pu)
-				if err != nil {
-					return nil, err
+				if err == nil {
+					u, err = userFromParsed(name, &pu)
 				}
-				u = User{
-					Name:        name,
-					Secret:      pu.Secret,
-					AdTag:       pu.Adtag,
-					Obfuscate:   pu.Obfuscate,
-					Socks5:      pu.Socks5,
-					Socks5_user: pu.Socks5_user,
-					Socks5_pass: pu.Socks5_pass,
+				if err != nil {
+					fail(fmt.Errorf("user %s: %w", name, err))
+					continue
 				}
 			default:
-				return nil, fmt.Errorf("unknown type for user %s: %s ", name, userRecordType)
+				fail(fmt.Errorf("unknown type for user %s: %s ", name, userRecordType))
+				continue
 			}
 			users.Users[name] = &u
 		}
-	} else if parsed.Users == nil && parsed.Secret != nil {
-		users = newOneUser(*parsed.Secret, parsed.Socks5, parsed.Socks5_user, parsed.Socks5_pass)
-	} else {
-		return nil, fmt.Errorf("specify either secret or users")
+	} else if parsed.Users == nil && parsed.Secret != nil && parsed.Users_file == nil {
+		users = newOneUser(*parsed.Secret)
+	} else if parsed.Users != nil || parsed.Secret != nil || parsed.Users_file == nil {
+		fail(fmt.Errorf("specify either secret or users (users_file)"))
 	}
-	return &Config{
+	c := &Config{
 		ignoreTimestamp: ignoreTimestamp,
-		listen_Urls:     listenUrls,
+		listeners:       listeners,
 		allowIPv6:       allowIPv6,
 		obfuscate:       obfuscate,
 		AdTag:           parsed.Adtag,
 		secret:          parsed.Secret,
 		host:            parsed.Host,
 		stats_sock:      parsed.Stats_Sock,
+		metricsListen:   metricsListen,
 		socks5:          parsed.Socks5,
 		socks5_user:     parsed.Socks5_user,
 		socks5_pass:     parsed.Socks5_pass,
+		drainTimeout:    drainTimeout,
+		reloadTerminate: reloadTerminate,
+		timeouts:        timeouts,
+		ipLimits:        ipLimits,
+		banFallback:     banFallback,
+		logLevel:        logLevel,
+		logJson:         logJson,
+		accessLog:       accessLog,
+		state:           state,
+		quota:           quota,
+		quotaPeriod:     quotaPeriod,
+		quotaFallback:   quotaFallback,
+		rateUp:          rateUp,
+		rateDown:        rateDown,
+		globalRate:      globalRate,
+		maxConnections:  maxConnections,
+		maxIPs:          maxIPs,
 		users:           users,
-	}, nil
+		profiles:        profiles,
+		inlineUsers:     users,
+	}
+	if parsed.Users_file != nil && *parsed.Users_file != "" {
+		c.usersFile = *parsed.Users_file
+		err := c.loadUsersFile()
+		if err != nil {
+			fail(err)
+		}
+	}
+	return c, errs
+}
+
+// use default for unspecified timeout, negative values are not allowed
+func parseTimeout(name string, value *time.Duration, def time.Duration) (time.Duration, error) {
+	if value == nil {
+		return def, nil
+	}
+	if *value < 0 {
+		return 0, fmt.Errorf("%s must not be negative", name)
+	}
+	return *value, nil
+}
+
+func parseIPLimits(parsed *parsedConfig) (limits ip_guard.Limits, banFallback bool, errs []error) {
+	for _, v := range []struct {
+		name  string
+		value *int
+		dest  *int
+	}{
+		{"ip_max_connections", parsed.Ip_max_connections, &limits.MaxConnections},
+		{"ip_handshakes_per_minute", parsed.Ip_handshakes_per_minute, &limits.HandshakesPerMinute},
+		{"ban_failures", parsed.Ban_failures, &limits.BanFailures},
+	} {
+		if v.value == nil {
+			continue
+		}
+		if *v.value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", v.name))
+			continue
+		}
+		*v.dest = *v.value
+	}
+	var err error
+	limits.BanWindow, err = parseTimeout("ban_window", parsed.Ban_window, defaultBanWindow)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	limits.BanTTL, err = parseTimeout("ban_ttl", parsed.Ban_ttl, defaultBanTTL)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if parsed.Ban_action != nil {
+		switch *parsed.Ban_action {
+		case "close":
+			banFallback = false
+		case "fallback":
+			banFallback = true
+		default:
+			errs = append(errs, fmt.Errorf("ban_action must be close or fallback"))
+		}
+	}
+	return
+}
+
+// listener can be specified by url string or by table with options
+func parseListener(md *toml.MetaData, entry toml.Primitive) (Listener, error) {
+	var url string
+	if md.PrimitiveDecode(entry, &url) == nil {
+		return Listener{Url: url, NoDelay: true}, nil
+	}
+	var pl parsedListener
+	err := md.PrimitiveDecode(entry, &pl)
+	if err != nil {
+		return Listener{}, err
+	}
+	l := Listener{
+		Users:   pl.Users,
+		Host:    pl.Host,
+		NoDelay: true,
+	}
+	switch {
+	case pl.Url != nil && pl.Unix != nil:
+		return Listener{}, fmt.Errorf("specify either url or unix for listener")
+	case pl.Url != nil && *pl.Url != "":
+		l.Url = *pl.Url
+	case pl.Unix != nil && *pl.Unix != "":
+		l.Unix = *pl.Unix
+	default:
+		return Listener{}, fmt.Errorf("listener url or unix path not specified")
+	}
+	if pl.Proxy_protocol != nil {
+		l.ProxyProtocol = *pl.Proxy_protocol
+	}
+	if pl.Tcp_nodelay != nil {
+		l.NoDelay = *pl.Tcp_nodelay
+	}
+	if pl.Tcp_keepalive != nil {
+		l.KeepAlive = *pl.Tcp_keepalive
+	}
+	return l, nil
+}
+
+// value of optional size, 0 if unspecified
+func optSize(s *Size) Size {
+	if s == nil {
+		return 0
+	}
+	return *s
+}
+
+func parseQuotaPeriod(s string) (stats.QuotaPeriod, error) {
+	switch period := stats.QuotaPeriod(s); period {
+	case stats.QuotaDaily, stats.QuotaMonthly:
+		return period, nil
+	default:
+		return "", fmt.Errorf("quota_period must be daily or monthly")
+	}
+}
+
+// user from fully defined user section
+func userFromParsed(name string, pu *parsedUserPrimitive) (User, error) {
+	err := pu.resolveCredentials()
+	if err != nil {
+		return User{}, err
+	}
+	u := User{
+		Name:           name,
+		Secret:         pu.Secret,
+		AdTag:          pu.Adtag,
+		Obfuscate:      pu.Obfuscate,
+		Socks5:         pu.Socks5,
+		Socks5_user:    pu.Socks5_user,
+		Socks5_pass:    pu.Socks5_pass,
+		Quota:          pu.Quota,
+		RateUp:         pu.Rate_up,
+		RateDown:       pu.Rate_down,
+		MaxConnections: pu.Max_connections,
+		MaxIPs:         pu.Max_ips,
+		Expires:        pu.Expires,
+		Disabled:       pu.Disabled != nil && *pu.Disabled,
+		AllowDCs:       pu.Allow_dcs,
+	}
+	if pu.Profile != nil {
+		u.Profile = *pu.Profile
+	}
+	// default label is index in all secrets of user
+	first := 0
+	if pu.Secret != "" {
+		first = 1
+	}
+	for i, ps := range pu.Secrets {
+		s := UserSecret{Secret: ps.Secret, NotAfter: ps.Not_after, Label: strconv.Itoa(first + i)}
+		if ps.Label != nil {
+			s.Label = *ps.Label
+		}
+		u.Secrets = append(u.Secrets, s)
+	}
+	if pu.Quota_period != nil {
+		period, err := parseQuotaPeriod(*pu.Quota_period)
+		if err != nil {
+			return u, err
+		}
+		u.QuotaPeriod = &period
+	}
+	u.AllowIPs, err = parseAllowIPs(pu.Allow_ips)
+	if err != nil {
+		return u, err
+	}
+	return u, nil
+}
+
+// profile is a table with user options except secret and profile
+func parseProfile(md *toml.MetaData, name string, data toml.Primitive) (*User, error) {
+	if md.Type("profiles", name) != "Hash" {
+		return nil, fmt.Errorf("profile must be table")
+	}
+	var pu parsedUserPrimitive
+	err := md.PrimitiveDecode(data, &pu)
+	if err != nil {
+		return nil, err
+	}
+	if pu.Secret != "" || pu.Secret_file != nil || pu.Secrets != nil || pu.Profile != nil {
+		return nil, fmt.Errorf("secrets and profile can't be set in profile")
+	}
+	p, err := userFromParsed(name, &pu)
+	if err != nil {
+		return nil, err
+	}
+	err = checkUserSocks(&p)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// parse list of networks, single addresses are allowed too
+func parseAllowIPs(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range list {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(s)
+			if addrErr != nil {
+				return nil, fmt.Errorf("can't parse allow_ips entry %q: %w", s, err)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// check that user has valid secrets with unique labels
+func checkSecrets(user *User) error {
+	secrets := user.AllSecrets()
+	if len(secrets) == 0 {
+		return fmt.Errorf("secret or secrets must be set")
+	}
+	labels := map[string]bool{}
+	keys := map[string]bool{}
+	for _, s := range secrets {
+		secret, err := tgcrypt_encryption.NewSecretHex(s.Secret)
+		if err != nil {
+			return fmt.Errorf("secret %s: %w", s.Label, err)
+		}
+		if s.Label == "" || labels[s.Label] {
+			return fmt.Errorf("secret labels must be unique and not empty")
+		}
+		if keys[string(secret.RawSecret)] {
+			return fmt.Errorf("secret %s is repeated", s.Label)
+		}
+		labels[s.Label] = true
+		keys[string(secret.RawSecret)] = true
+	}
+	return nil
 }
 
 func checkUser(user *User) error {
+	if user.Quota != nil && *user.Quota < 0 {
+		return fmt.Errorf("quota must not be negative")
+	}
+	if (user.RateUp != nil && *user.RateUp < 0) || (user.RateDown != nil && *user.RateDown < 0) {
+		return fmt.Errorf("rate limits must not be negative")
+	}
+	if (user.MaxConnections != nil && *user.MaxConnections < 0) || (user.MaxIPs != nil && *user.MaxIPs < 0) {
+		return fmt.Errorf("max_connections and max_ips must not be negative")
+	}
+	for _, dc := range user.AllowDCs {
+		if dc < 1 || dc > tgcrypt_encryption.DcMaxIdx {
+			return fmt.Errorf("allow_dcs entry %d is not in 1..%d", dc, tgcrypt_encryption.DcMaxIdx)
+		}
+	}
 	if user.AdTag != nil {
 		if user.Socks5 != nil {
 			return fmt.Errorf("middle proxy requires direct connection")
@@ -1,9 +1,17 @@
 package config
 
 import (
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/geovex/tgp/internal/stats"
 )
 
 func TestDefaultConfig(t *testing.T) {
@@ -215,3 +223,1010 @@ func TestInheritAdTag(t *testing.T) {
 		t.Errorf("override2 user addtag not invalid")
 	}
 }
+
+func TestDrainTimeout(t *testing.T) {
+	config := `
+		listen_url = "0.0.0.0:6666"
+		drain_timeout = "1m30s"
+		secret = "dd000102030405060708090a0b0c0d0e0f"
+	`
+	var pc parsedConfig
+	md, err := toml.Decode(config, &pc)
+	if err != nil {
+		t.Errorf("drain timeout config not decoded: %v", err)
+	}
+	c, err := configFromParsed(&pc, &md)
+	if err != nil {
+		t.Errorf("drain timeout config not parsed: %v", err)
+	}
+	if c.GetDrainTimeout() != 90*time.Second {
+		t.Errorf("drain_timeout not parsed correctly: %v", c.GetDrainTimeout())
+	}
+}
+
+func TestReloadTerminate(t *testing.T) {
+	config := `
+		listen_url = "0.0.0.0:6666"
+		reload_terminate = true
+		secret = "dd000102030405060708090a0b0c0d0e0f"
+	`
+	var pc parsedConfig
+	md, err := toml.Decode(config, &pc)
+	if err != nil {
+		t.Errorf("reload config not decoded: %v", err)
+	}
+	c, err := configFromParsed(&pc, &md)
+	if err != nil {
+		t.Errorf("reload config not parsed: %v", err)
+	}
+	if !c.GetReloadTerminate() {
+		t.Errorf("reload_terminate not parsed correctly")
+	}
+}
+
+func TestCheckConfigAllProblems(t *testing.T) {
+	config := `
+		listen_url = "0.0.0.0:6666"
+		socks5 = "127.0.0.1:9050"
+		[users.proxied]
+		secret = "dd000102030405060708090a0b0c0d0e0f"
+		adtag = "000102030405060708090a0b0c0d0e0f"
+		[users.bad_adtag]
+		secret = "dd101112131415161718191a1b1c1d1e1f"
+		socks5 = ""
+		adtag = "00"
+	`
+	var pc parsedConfig
+	md, err := toml.Decode(config, &pc)
+	if err != nil {
+		t.Errorf("invalid config not decoded: %v", err)
+	}
+	c, errs := configFromParsedUnchecked(&pc, &md)
+	if len(errs) > 0 {
+		t.Errorf("invalid config not parsed: %v", errs)
+	}
+	errs = checkConfig(c, &md)
+	if len(errs) != 2 {
+		t.Errorf("expected 2 problems, got %v", errs)
+	}
+}
+
+func TestListenerTables(t *testing.T) {
+	config := `
+		listen_url = ["0.0.0.0:6666", {url = "0.0.0.0:6667", proxy_protocol = true}]
+		secret = "dd000102030405060708090a0b0c0d0e0f"
+	`
+	var pc parsedConfig
+	md, err := toml.Decode(config, &pc)
+	if err != nil {
+		t.Errorf("listener config not decoded: %v", err)
+	}
+	c, err := configFromParsed(&pc, &md)
+	if err != nil {
+		t.Errorf("listener config not parsed: %v", err)
+	}
+	listeners := c.GetListeners()
+	if len(listeners) != 2 || listeners[0].ProxyProtocol || !listeners[1].ProxyProtocol {
+		t.Errorf("listeners not parsed correctly: %v", listeners)
+	}
+	if listeners[1].Url != "0.0.0.0:6667" {
+		t.Errorf("listener url not parsed correctly: %s", listeners[1].Url)
+	}
+}
+
+func TestListenerOptions(t *testing.T) {
+	config := `
+		listen_url = "0.0.0.0:6666"
+		secret = "dd000102030405060708090a0b0c0d0e0f"
+	`
+	var pc parsedConfig
+	md, err := toml.Decode(config, &pc)
+	if err != nil {
+		t.Errorf("listener config not decoded: %v", err)
+	}
+	c, err := configFromParsed(&pc, &md)
+	if err != nil {
+		t.Errorf("listener config not parsed: %v", err)
+	}
+	if !c.GetListeners()[0].NoDelay {
+		t.Errorf("nodelay not enabled by default")
+	}
+	config = `
+		host = "google.com:443"
+		[[listen_url]]
+		url = "0.0.0.0:443"
+		users = ["one"]
+		host = ""
+		tcp_nodelay = false
+		tcp_keepalive = "30s"
+		[[listen_url]]
+		unix = "/run/tgp.sock"
+		proxy_protocol = true
+		[users]
+		one = "dd000102030405060708090a0b0c0d0e0f"
+		two = "dd101112131415161718191a1b1c1d1e1f"
+	`
+	pc = parsedConfig{}
+	md, err = toml.Decode(config, &pc)
+	if err != nil {
+		t.Errorf("listener config not decoded: %v", err)
+	}
+	c, err = configFromParsed(&pc, &md)
+	if err != nil {
+		t.Errorf("listener config not parsed: %v", err)
+	}
+	tcp := c.GetListener("0.0.0.0:443")
+	if tcp == nil || len(tcp.Users) != 1 || tcp.Users[0] != "one" {
+		t.Errorf("listener users not parsed correctly: %v", tcp)
+	}
+	if tcp.Host == nil || *tcp.Host != "" || tcp.NoDelay || tcp.KeepAlive != 30*time.Second {
+		t.Errorf("listener options not parsed correctly: %v", tcp)
+	}
+	unix := c.GetListener("unix:/run/tgp.sock")
+	if unix == nil || !unix.ProxyProtocol || unix.Url != "" {
+		t.Errorf("unix listener not parsed correctly: %v", unix)
+	}
+	if len(c.GetListenUrl()) != 1 {
+		t.Errorf("unix listener reported as url")
+	}
+}
+
+func TestListenerUnknownUser(t *testing.T) {
+	config := `
+		listen_url = {url = "0.0.0.0:443", users = ["nobody"]}
+		secret = "dd000102030405060708090a0b0c0d0e0f"
+	`
+	var pc parsedConfig
+	md, err := toml.Decode(config, &pc)
+	if err != nil {
+		t.Errorf("listener config not decoded: %v", err)
+	}
+	_, err = configFromParsed(&pc, &md)
+	if err == nil {
+		t.Errorf("listener with unknown user accepted")
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	config := `
+		listen_url = "0.0.0.0:6666"
+		handshake_timeout = "3s"
+		idle_timeout = 0
+		secret = "dd000102030405060708090a0b0c0d0e0f"
+	`
+	var pc parsedConfig
+	md, err := toml.Decode(config, &pc)
+	if err != nil {
+		t.Errorf("timeouts config not decoded: %v", err)
+	}
+	c, err := configFromParsed(&pc, &md)
+	if err != nil {
+		t.Errorf("timeouts config not parsed: %v", err)
+	}
+	timeouts := c.GetTimeouts()
+	if timeouts.Handshake != 3*time.Second {
+		t.Errorf("handshake_timeout not parsed correctly: %v", timeouts.Handshake)
+	}
+	if timeouts.DcConnect != defaultDcConnectTimeout {
+		t.Errorf("dc_connect_timeout default not applied: %v", timeouts.DcConnect)
+	}
+	if timeouts.Idle != 0 {
+		t.Errorf("idle_timeout not disabled: %v", timeouts.Idle)
+	}
+}
+
+func TestIPLimits(t *testing.T) {
+	config := `
+		listen_url = "0.0.0.0:6666"
+		ip_max_connections = 10
+		ban_failures = 5
+		ban_ttl = "1h"
+		ban_action = "fallback"
+		secret = "dd000102030405060708090a0b0c0d0e0f"
+	`
+	var pc parsedConfig
+	md, err := toml.Decode(config, &pc)
+	if err != nil {
+		t.Errorf("ip limits config not decoded: %v", err)
+	}
+	c, err := configFromParsed(&pc, &md)
+	if err != nil {
+		t.Errorf("ip limits config not parsed: %v", err)
+	}
+	limits := c.GetIPLimits()
+	if limits.MaxConnections != 10 || limits.HandshakesPerMinute != 0 || limits.BanFailures != 5 {
+		t.Errorf("ip limits not parsed correctly: %v", limits)
+	}
+	if limits.BanTTL != time.Hour || limits.BanWindow != defaultBanWindow {
+		t.Errorf("ban durations not parsed correctly: %v", limits)
+	}
+	if !c.GetBanFallback() {
+		t.Errorf("ban_action not parsed correctly")
+	}
+	config = `
+		listen_url = "0.0.0.0:6666"
+		ban_action = "drop"
+		secret = "dd000102030405060708090a0b0c0d0e0f"
+	`
+	pc = parsedConfig{}
+	md, err = toml.Decode(config, &pc)
+	if err != nil {
+		t.Errorf("ip limits config not decoded: %v", err)
+	}
+	_, err = configFromParsed(&pc, &md)
+	if err == nil {
+		t.Errorf("invalid ban_action accepted")
+	}
+}
+
+func TestLogOptions(t *testing.T) {
+	config := `
+		listen_url = "0.0.0.0:6666"
+		log_level = "debug"
+		log_format = "json"
+		secret = "dd000102030405060708090a0b0c0d0e0f"
+	`
+	var pc parsedConfig
+	md, err := toml.Decode(config, &pc)
+	if err != nil {
+		t.Errorf("log config not decoded: %v", err)
+	}
+	c, err := configFromParsed(&pc, &md)
+	if err != nil {
+		t.Errorf("log config not parsed: %v", err)
+	}
+	if c.GetLogLevel() != slog.LevelDebug || !c.GetLogJson() {
+		t.Errorf("log options not parsed correctly")
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	config := `
+		listen_url = "0.0.0.0:6666"
+		access_log = "/tmp/access.jsonl"
+		access_log_max_size = "10MB"
+		secret = "dd000102030405060708090a0b0c0d0e0f"
+	`
+	var pc parsedConfig
+	md, err := toml.Decode(config, &pc)
+	if err != nil {
+		t.Errorf("access log config not decoded: %v", err)
+	}
+	c, err := configFromParsed(&pc, &md)
+	if err != nil {
+		t.Errorf("access log config not parsed: %v", err)
+	}
+	a := c.GetAccessLog()
+	if a.Path != "/tmp/access.jsonl" || a.MaxSize != 10<<20 || a.MaxFiles != defaultAccessLogMaxFiles {
+		t.Errorf("access log options not parsed correctly: %+v", a)
+	}
+}
+
+func TestMetricsListen(t *testing.T) {
+	config := `
+		listen_url = "0.0.0.0:6666"
+		metrics_listen = "127.0.0.1:9100"
+		secret = "dd000102030405060708090a0b0c0d0e0f"
+	`
+	var pc parsedConfig
+	md, err := toml.Decode(config, &pc)
+	if err != nil {
+		t.Errorf("metrics config not decoded: %v", err)
+	}
+	c, err := configFromParsed(&pc, &md)
+	if err != nil {
+		t.Errorf("metrics config not parsed: %v", err)
+	}
+	if c.GetMetricsListen() != "127.0.0.1:9100" {
+		t.Errorf("metrics_listen not parsed correctly")
+	}
+	bad := "9100"
+	pc.Metrics_listen = &bad
+	_, err = configFromParsed(&pc, &md)
+	if err == nil {
+		t.Errorf("metrics_listen without port accepted")
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	config := `
+		listen_url = "0.0.0.0:6666"
+		state_file = "/var/lib/tgp/state.json"
+		secret = "dd000102030405060708090a0b0c0d0e0f"
+	`
+	var pc parsedConfig
+	md, err := toml.Decode(config, &pc)
+	if err != nil {
+		t.Errorf("state config not decoded: %v", err)
+	}
+	c, err := configFromParsed(&pc, &md)
+	if err != nil {
+		t.Errorf("state config not parsed: %v", err)
+	}
+	state := c.GetStateFile()
+	if state.Path != "/var/lib/tgp/state.json" || state.FlushInterval != defaultStateFlushInterval {
+		t.Errorf("state options not parsed correctly: %+v", state)
+	}
+	zero := time.Duration(0)
+	pc.State_flush_interval = &zero
+	_, err = configFromParsed(&pc, &md)
+	if err == nil {
+		t.Errorf("zero state_flush_interval accepted")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	config := `
+		listen_url = "0.0.0.0:6666"
+		quota = "50GB"
+		quota_action = "fallback"
+		[users]
+		1 = "dd000102030405060708090a0b0c0d0e0f"
+		[users.2]
+		secret = "dd101112131415161718191a1b1c1d1e1f"
+		quota = "1GB"
+		quota_period = "daily"
+		[users.3]
+		secret = "dd202122232425262728292a2b2c2d2e2f"
+		quota = 0
+	`
+	var pc parsedConfig
+	md, err := toml.Decode(config, &pc)
+	if err != nil {
+		t.Errorf("quota config not decoded: %v", err)
+	}
+	c, err := configFromParsed(&pc, &md)
+	if err != nil {
+		t.Fatalf("quota config not parsed: %v", err)
+	}
+	for _, v := range []struct {
+		user   string
+		quota  Size
+		period stats.QuotaPeriod
+	}{
+		{"1", 50 << 30, stats.QuotaMonthly},
+		{"2", 1 << 30, stats.QuotaDaily},
+		{"3", 0, stats.QuotaMonthly},
+	} {
+		u, _ := c.GetUser(v.user)
+		if *u.Quota != v.quota || *u.QuotaPeriod != v.period {
+			t.Errorf("user %s: quota %v %v, expected %v %v", v.user, *u.Quota, *u.QuotaPeriod, v.quota, v.period)
+		}
+	}
+	if !c.GetQuotaFallback() {
+		t.Errorf("quota_action not parsed")
+	}
+	weekly := "weekly"
+	pc.Quota_period = &weekly
+	_, err = configFromParsed(&pc, &md)
+	if err == nil {
+		t.Errorf("invalid quota_period accepted")
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	config := `
+		listen_url = "0.0.0.0:6666"
+		rate_up = "1MB"
+		global_rate_down = "100MB"
+		[users]
+		1 = "dd000102030405060708090a0b0c0d0e0f"
+		[users.2]
+		secret = "dd101112131415161718191a1b1c1d1e1f"
+		rate_up = 0
+		rate_down = "512KB"
+	`
+	var pc parsedConfig
+	md, err := toml.Decode(config, &pc)
+	if err != nil {
+		t.Errorf("rate config not decoded: %v", err)
+	}
+	c, err := configFromParsed(&pc, &md)
+	if err != nil {
+		t.Fatalf("rate config not parsed: %v", err)
+	}
+	u1, _ := c.GetUser("1")
+	u2, _ := c.GetUser("2")
+	if *u1.RateUp != 1<<20 || *u1.RateDown != 0 || *u2.RateUp != 0 || *u2.RateDown != 512<<10 {
+		t.Errorf("user rates not inherited correctly")
+	}
+	if c.GetGlobalRate() != (Rates{Down: 100 << 20}) {
+		t.Errorf("global rate not parsed: %+v", c.GetGlobalRate())
+	}
+}
+
+func TestUserConnectionLimits(t *testing.T) {
+	config := `
+		listen_url = "0.0.0.0:6666"
+		max_connections = 10
+		[users]
+		1 = "dd000102030405060708090a0b0c0d0e0f"
+		[users.2]
+		secret = "dd101112131415161718191a1b1c1d1e1f"
+		max_connections = 0
+		max_ips = 2
+	`
+	var pc parsedConfig
+	md, err := toml.Decode(config, &pc)
+	if err != nil {
+		t.Errorf("limits config not decoded: %v", err)
+	}
+	c, err := configFromParsed(&pc, &md)
+	if err != nil {
+		t.Fatalf("limits config not parsed: %v", err)
+	}
+	u1, _ := c.GetUser("1")
+	u2, _ := c.GetUser("2")
+	if *u1.MaxConnections != 10 || *u1.MaxIPs != 0 || *u2.MaxConnections != 0 || *u2.MaxIPs != 2 {
+		t.Errorf("connection limits not inherited correctly")
+	}
+}
+
+func TestUserExpiry(t *testing.T) {
+	config := `
+		listen_url = "0.0.0.0:6666"
+		[users]
+		1 = "dd000102030405060708090a0b0c0d0e0f"
+		[users.2]
+		secret = "dd101112131415161718191a1b1c1d1e1f"
+		expires = 2026-12-31T00:00:00Z
+		[users.3]
+		secret = "dd202122232425262728292a2b2c2d2e2f"
+		disabled = true
+	`
+	var pc parsedConfig
+	md, err := toml.Decode(config, &pc)
+	if err != nil {
+		t.Errorf("expiry config not decoded: %v", err)
+	}
+	c, err := configFromParsed(&pc, &md)
+	if err != nil {
+		t.Fatalf("expiry config not parsed: %v", err)
+	}
+	before := time.Date(2026, 12, 30, 0, 0, 0, 0, time.UTC)
+	after := time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC)
+	if !c.IsUserActive("1", after) || !c.IsUserActive("2", before) || c.IsUserActive("2", after) {
+		t.Errorf("user expiry not applied")
+	}
+	if c.IsUserActive("3", before) || c.IsUserActive("4", before) {
+		t.Errorf("disabled or unknown user is active")
+	}
+	u2, _ := c.GetUser("2")
+	u3, _ := c.GetUser("3")
+	if u2.InactiveReason(after) != stats.ReasonUserExpired || u3.InactiveReason(before) != stats.ReasonUserDisabled {
+		t.Errorf("wrong inactive reasons")
+	}
+}
+
+func TestUserAllowLists(t *testing.T) {
+	config := `
+		listen_url = "0.0.0.0:6666"
+		[users]
+		1 = "dd000102030405060708090a0b0c0d0e0f"
+		[users.2]
+		secret = "dd101112131415161718191a1b1c1d1e1f"
+		allow_ips = ["10.0.0.0/8", "192.168.1.1", "2001:db8::/32"]
+		allow_dcs = [2, 4]
+	`
+	var pc parsedConfig
+	md, err := toml.Decode(config, &pc)
+	if err != nil {
+		t.Errorf("allow lists config not decoded: %v", err)
+	}
+	c, err := configFromParsed(&pc, &md)
+	if err != nil {
+		t.Fatalf("allow lists config not parsed: %v", err)
+	}
+	u1, _ := c.GetUser("1")
+	u2, _ := c.GetUser("2")
+	if !u1.AllowsIP(netip.MustParseAddr("1.2.3.4")) || !u1.AllowsDC(1) {
+		t.Errorf("user without allow lists is restricted")
+	}
+	for ip, allowed := range map[string]bool{
+		"10.1.2.3":        true,
+		"::ffff:10.1.2.3": true,
+		"192.168.1.1":     true,
+		"192.168.1.2":     false,
+		"2001:db8::1":     true,
+		"2001:db9::1":     false,
+		"11.0.0.1":        false,
+	} {
+		if u2.AllowsIP(netip.MustParseAddr(ip)) != allowed {
+			t.Errorf("wrong allow_ips result for %s", ip)
+		}
+	}
+	if !u2.AllowsDC(2) || !u2.AllowsDC(-4) || u2.AllowsDC(1) {
+		t.Errorf("wrong allow_dcs result")
+	}
+	for _, bad := range []string{`allow_ips = ["10.0.0.0/33"]`, `allow_dcs = [0]`, `allow_dcs = [6]`} {
+		config := `
+			listen_url = "0.0.0.0:6666"
+			[users.1]
+			secret = "dd000102030405060708090a0b0c0d0e0f"
+			` + bad
+		var pc parsedConfig
+		md, err := toml.Decode(config, &pc)
+		if err != nil {
+			t.Errorf("config not decoded: %v", err)
+		}
+		_, err = configFromParsed(&pc, &md)
+		if err == nil {
+			t.Errorf("invalid %s accepted", bad)
+		}
+	}
+}
+
+func TestUsersFile(t *testing.T) {
+	dir := t.TempDir()
+	jsonlPath := filepath.Join(dir, "users.jsonl")
+	jsonl := `{"name": "2", "secret": "dd101112131415161718191a1b1c1d1e1f", "quota": "1GB", "max_ips": 2}
+
+{"name": "3", "secret": "not hex"}
+{"name": "4", "secret": "dd303132333435363738393a3b3c3d3e3f", "unknown": 1}
+{"name": "1", "secret": "dd404142434445464748494a4b4c4d4e4f"}
+{"name": "5", "secret": "dd505152535455565758595a5b5c5d5e5f", "expires": "2026-12-31T00:00:00Z"}
+`
+	err := os.WriteFile(jsonlPath, []byte(jsonl), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := `
+		listen_url = "0.0.0.0:6666"
+		users_file = "` + jsonlPath + `"
+		[users]
+		1 = "dd000102030405060708090a0b0c0d0e0f"
+	`
+	var pc parsedConfig
+	md, err := toml.Decode(config, &pc)
+	if err != nil {
+		t.Errorf("users file config not decoded: %v", err)
+	}
+	c, err := configFromParsed(&pc, &md)
+	if err != nil {
+		t.Fatalf("users file config not parsed: %v", err)
+	}
+	u2, err := c.GetUser("2")
+	if err != nil || *u2.Quota != 1<<30 || *u2.MaxIPs != 2 {
+		t.Errorf("user from jsonl file not loaded: %v", err)
+	}
+	if !c.HasUser("5") || c.HasUser("3") || c.HasUser("4") {
+		t.Errorf("wrong users loaded from jsonl file")
+	}
+	if secret, _ := c.GetUserSecret("1"); secret != "dd000102030405060708090a0b0c0d0e0f" {
+		t.Errorf("users file entry replaced user of main config")
+	}
+	errs := c.GetUserErrors()
+	if len(errs) != 3 {
+		t.Errorf("expected 3 skipped entries, got %v", errs)
+	}
+	for i, line := range []string{":3:", ":4:", "duplicate"} {
+		if i < len(errs) && !strings.Contains(errs[i].Error(), line) {
+			t.Errorf("entry error %q has no %q", errs[i], line)
+		}
+	}
+	if c.UsersFileChanged() {
+		t.Errorf("unchanged users file reported as changed")
+	}
+	err = os.WriteFile(jsonlPath, []byte(`{"name": "6", "secret": "dd606162636465666768696a6b6c6d6e6f"}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.UsersFileChanged() {
+		t.Errorf("changed users file not detected")
+	}
+	nc, err := c.ReloadUsers()
+	if err != nil {
+		t.Fatalf("users file not reloaded: %v", err)
+	}
+	if !nc.HasUser("1") || !nc.HasUser("6") || nc.HasUser("2") || !c.HasUser("2") {
+		t.Errorf("wrong users after reload")
+	}
+
+	tomlPath := filepath.Join(dir, "users.toml")
+	err = os.WriteFile(tomlPath, []byte(`
+7 = "dd707172737475767778797a7b7c7d7e7f"
+[8]
+secret = "dd808182838485868788898a8b8c8d8e8f"
+rate_up = "1MB"
+[9]
+secret = "dd909192939495969798999a9b9c9d9e9f"
+quota_period = "weekly"
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, errs, err := readUsersToml(tomlPath, mustRead(t, tomlPath))
+	if err != nil || len(users) != 2 {
+		t.Errorf("users not read from toml file: %v", err)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "users.toml:6: user 9") {
+		t.Errorf("wrong toml entry errors: %v", errs)
+	}
+}
+
+func mustRead(t *testing.T, path string) []byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestCredentials(t *testing.T) {
+	dir := t.TempDir()
+	secretPath := filepath.Join(dir, "secret")
+	err := os.WriteFile(secretPath, []byte("dd000102030405060708090a0b0c0d0e0f\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passPath := filepath.Join(dir, "pass")
+	err = os.WriteFile(passPath, []byte("filepass\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TGP_TEST_PASS", "p@ss")
+	t.Setenv("TGP_TEST_USER", "proxyuser")
+	t.Setenv("TGP_TEST_SECRET", "dd101112131415161718191a1b1c1d1e1f")
+	config := `
+		listen_url = "0.0.0.0:6666"
+		socks5 = "127.0.0.1:9050"
+		socks5_user = "root${TGP_TEST_USER}"
+		socks5_pass = "x${TGP_TEST_PASS}x"
+		[users]
+		2 = "${TGP_TEST_SECRET}"
+		[users.1]
+		secret_file = "` + secretPath + `"
+		socks5 = "127.0.0.1:9051"
+		socks5_user = "user${TGP_TEST_USER}"
+		socks5_pass_file = "` + passPath + `"
+	`
+	var pc parsedConfig
+	md, err := toml.Decode(config, &pc)
+	if err != nil {
+		t.Errorf("credentials config not decoded: %v", err)
+	}
+	c, err := configFromParsed(&pc, &md)
+	if err != nil {
+		t.Fatalf("credentials config not parsed: %v", err)
+	}
+	u1, _ := c.GetUser("1")
+	u2, _ := c.GetUser("2")
+	if u1.Secret != "dd000102030405060708090a0b0c0d0e0f" || u2.Secret != "dd101112131415161718191a1b1c1d1e1f" {
+		t.Errorf("secrets not resolved: %q %q", u1.Secret, u2.Secret)
+	}
+	if *u2.Socks5_pass != "xp@ssx" || *u1.Socks5_pass != "filepass" {
+		t.Errorf("socks5_pass not expanded: %q %q", *u2.Socks5_pass, *u1.Socks5_pass)
+	}
+	b := &strings.Builder{}
+	err = c.WriteEffective(b)
+	if err != nil {
+		t.Fatalf("effective config not written: %v", err)
+	}
+	for _, credential := range []string{"p@ss", "proxyuser", "filepass", "0102030405", "1112131415"} {
+		if strings.Contains(b.String(), credential) {
+			t.Errorf("credential %s not redacted:\n%s", credential, b.String())
+		}
+	}
+	for _, bad := range []string{
+		`secret = "${TGP_TEST_UNSET}"`,
+		`secret = "dd000102030405060708090a0b0c0d0e0f"
+		secret_file = "` + secretPath + `"`,
+		`secret_file = "` + filepath.Join(dir, "missing") + `"`,
+	} {
+		config := `
+			listen_url = "0.0.0.0:6666"
+			[users.1]
+			` + bad
+		var pc parsedConfig
+		md, err := toml.Decode(config, &pc)
+		if err != nil {
+			t.Errorf("config not decoded: %v", err)
+		}
+		_, err = configFromParsed(&pc, &md)
+		if err == nil {
+			t.Errorf("invalid credentials accepted: %s", bad)
+		}
+	}
+}
+
+func TestStrictValidation(t *testing.T) {
+	config := `
+		listen_url = ["0.0.0.0:66666", {url = "0.0.0.0:6667", host = "example.com"}]
+		allowipv6 = true
+		host = "google.com"
+		socks5 = "127.0.0.1"
+		idle_timeout = "-1s"
+		log_format = "xml"
+		[users]
+		1 = "dd000102030405060708090a0b0c0d0e0f"
+		2 = "000102030405060708090a0b0c0d0e0f"
+		3 = "not hex"
+		[users.4]
+		secret = "dd101112131415161718191a1b1c1d1e1f"
+		socks5 = "proxy:port"
+		quota_priod = "daily"
+	`
+	var pc parsedConfig
+	md, err := toml.Decode(config, &pc)
+	if err != nil {
+		t.Fatalf("invalid config not decoded: %v", err)
+	}
+	_, err = configFromParsed(&pc, &md)
+	if err == nil {
+		t.Fatalf("invalid config accepted")
+	}
+	for _, problem := range []string{
+		"unknown option allowipv6",
+		"unknown option users.4.quota_priod",
+		"listener 0.0.0.0:66666: invalid address",
+		"listener 0.0.0.0:6667: invalid host",
+		"invalid host",
+		"socks5 must be host:port",
+		"idle_timeout must not be negative",
+		"log_format must be text or json",
+		"users 1 and 2 have same secret",
+		"invalid secret for user 3",
+		"invalid config for user 4: socks5 must be host:port",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("problem %q not reported in:\n%v", problem, err)
+		}
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	config := `
+		listen_url = "0.0.0.0:6666"
+		socks5 = "127.0.0.1:9050"
+		max_connections = 10
+		rate_up = "1MB"
+		[profiles.eu_socks]
+		socks5 = "10.0.0.1:1080"
+		socks5_user = "eu"
+		max_connections = 5
+		[profiles.direct]
+		socks5 = ""
+		disabled = true
+		[users]
+		1 = "dd000102030405060708090a0b0c0d0e0f"
+		[users.2]
+		secret = "dd101112131415161718191a1b1c1d1e1f"
+		profile = "eu_socks"
+		[users.3]
+		secret = "dd202122232425262728292a2b2c2d2e2f"
+		profile = "eu_socks"
+		max_connections = 1
+		[users.4]
+		secret = "dd303132333435363738393a3b3c3d3e3f"
+		profile = "direct"
+	`
+	var pc parsedConfig
+	md, err := toml.Decode(config, &pc)
+	if err != nil {
+		t.Errorf("profiles config not decoded: %v", err)
+	}
+	c, err := configFromParsed(&pc, &md)
+	if err != nil {
+		t.Fatalf("profiles config not parsed: %v", err)
+	}
+	u1, _ := c.GetUser("1")
+	u2, _ := c.GetUser("2")
+	u3, _ := c.GetUser("3")
+	u4, _ := c.GetUser("4")
+	if *u1.Socks5 != "127.0.0.1:9050" || *u1.MaxConnections != 10 {
+		t.Errorf("user without profile doesn't inherit root")
+	}
+	if *u2.Socks5 != "10.0.0.1:1080" || *u2.Socks5_user != "eu" || *u2.MaxConnections != 5 || *u2.RateUp != 1<<20 {
+		t.Errorf("user doesn't inherit profile and root")
+	}
+	if *u3.MaxConnections != 1 || *u3.Socks5 != "10.0.0.1:1080" {
+		t.Errorf("user settings don't override profile")
+	}
+	if u4.Socks5 != nil || !u4.Disabled || c.IsUserActive("4", time.Now()) {
+		t.Errorf("profile overrides of root not applied")
+	}
+	for _, bad := range []string{
+		`[users.1]
+		secret = "dd000102030405060708090a0b0c0d0e0f"
+		profile = "missing"`,
+		`[profiles.p]
+		secret = "dd000102030405060708090a0b0c0d0e0f"
+		[users.1]
+		secret = "dd000102030405060708090a0b0c0d0e0f"
+		profile = "p"`,
+	} {
+		config := `
+			listen_url = "0.0.0.0:6666"
+			` + bad
+		var pc parsedConfig
+		md, err := toml.Decode(config, &pc)
+		if err != nil {
+			t.Errorf("config not decoded: %v", err)
+		}
+		_, err = configFromParsed(&pc, &md)
+		if err == nil {
+			t.Errorf("invalid profile config accepted: %s", bad)
+		}
+	}
+}
+
+func TestUserSecrets(t *testing.T) {
+	config := `
+		listen_url = "0.0.0.0:6666"
+		[users.1]
+		secret = "dd000102030405060708090a0b0c0d0e0f"
+		secrets = [
+			{secret = "dd101112131415161718191a1b1c1d1e1f", not_after = 2026-01-01T00:00:00Z},
+			{secret = "ee202122232425262728292a2b2c2d2e2f676f6f676c652e636f6d", label = "tls"},
+		]
+		[users.2]
+		secrets = [{secret = "dd303132333435363738393a3b3c3d3e3f"}]
+	`
+	var pc parsedConfig
+	md, err := toml.Decode(config, &pc)
+	if err != nil {
+		t.Errorf("secrets config not decoded: %v", err)
+	}
+	c, err := configFromParsed(&pc, &md)
+	if err != nil {
+		t.Fatalf("secrets config not parsed: %v", err)
+	}
+	u1, _ := c.GetUser("1")
+	labels := []string{}
+	for _, s := range u1.AllSecrets() {
+		labels = append(labels, s.Label)
+	}
+	if !slices.Equal(labels, []string{"0", "1", "tls"}) {
+		t.Errorf("unexpected secret labels %v", labels)
+	}
+	if len(u1.ActiveSecrets(time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC))) != 3 ||
+		len(u1.ActiveSecrets(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))) != 2 {
+		t.Errorf("not_after not applied")
+	}
+	u2, _ := c.GetUser("2")
+	if s := u2.AllSecrets(); len(s) != 1 || s[0].Label != "0" {
+		t.Errorf("unexpected secrets of user without secret option %+v", s)
+	}
+	for _, bad := range []string{
+		`[users.1]
+		secrets = []`,
+		`[users.1]
+		secrets = [{secret = "dd000102030405060708090a0b0c0d0e0f", label = "a"},
+			{secret = "dd101112131415161718191a1b1c1d1e1f", label = "a"}]`,
+		`[users.1]
+		secret = "dd000102030405060708090a0b0c0d0e0f"
+		secrets = [{secret = "000102030405060708090a0b0c0d0e0f"}]`,
+		`[users.1]
+		secret = "dd000102030405060708090a0b0c0d0e0f"
+		[users.2]
+		secrets = [{secret = "dd101112131415161718191a1b1c1d1e1f"},
+			{secret = "dd000102030405060708090a0b0c0d0e0f"}]`,
+		`[profiles.p]
+		secrets = [{secret = "dd000102030405060708090a0b0c0d0e0f"}]
+		[users.1]
+		secret = "dd101112131415161718191a1b1c1d1e1f"`,
+	} {
+		config := `
+			listen_url = "0.0.0.0:6666"
+			` + bad
+		var pc parsedConfig
+		md, err := toml.Decode(config, &pc)
+		if err != nil {
+			t.Errorf("config not decoded: %v", err)
+		}
+		_, err = configFromParsed(&pc, &md)
+		if err == nil {
+			t.Errorf("invalid secrets config accepted: %s", bad)
+		}
+	}
+	users, errs := readUsersJsonl("users.jsonl", []byte(
+		`{"name": "3", "secrets": [{"secret": "dd404142434445464748494a4b4c4d4e4f", "not_after": "2026-01-01T00:00:00Z", "label": "old"}]}`+"\n"))
+	if len(errs) != 0 || len(users) != 1 || users[0].user.Secrets[0].Label != "old" || users[0].user.Secrets[0].NotAfter == nil {
+		t.Errorf("secrets not read from jsonl: %v", errs)
+	}
+}
+
+func TestUsersFileInheritedCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.jsonl")
+	// adtag requires direct connection, but root socks5 is inherited
+	jsonl := `{"name": "2", "secret": "dd101112131415161718191a1b1c1d1e1f"}
+{"name": "3", "secret": "dd202122232425262728292a2b2c2d2e2f", "adtag": "00000000000000000000000000000001"}
+`
+	if err := os.WriteFile(path, []byte(jsonl), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := `
+		listen_url = "0.0.0.0:6666"
+		socks5 = "127.0.0.1:9050"
+		users_file = "` + path + `"
+		[users]
+		1 = "dd000102030405060708090a0b0c0d0e0f"
+	`
+	var pc parsedConfig
+	md, err := toml.Decode(config, &pc)
+	if err != nil {
+		t.Errorf("config not decoded: %v", err)
+	}
+	c, err := configFromParsed(&pc, &md)
+	if err != nil {
+		t.Fatalf("invalid users file entry rejected whole config: %v", err)
+	}
+	check := func(c *Config) {
+		errs := c.GetUserErrors()
+		if !c.HasUser("2") || c.HasUser("3") || len(errs) != 1 ||
+			!strings.Contains(errs[0].Error(), path+":2: user 3: middle proxy requires direct connection") {
+			t.Errorf("entry with inherited conflict not skipped: %v", errs)
+		}
+	}
+	check(c)
+	nc, err := c.ReloadUsers()
+	if err != nil {
+		t.Fatalf("users file not reloaded: %v", err)
+	}
+	check(nc)
+}
+
+func TestValidationOrder(t *testing.T) {
+	config := `
+		listen_url = "0.0.0.0:6666"
+		[profiles.b]
+		quota_period = "weekly"
+		[profiles.a]
+		quota_period = "weekly"
+		[users.d]
+		secret = "dd000102030405060708090a0b0c0d0e0f"
+		quota_period = "weekly"
+		[users.c]
+		secret = "dd101112131415161718191a1b1c1d1e1f"
+		quota_period = "weekly"
+	`
+	var first string
+	for i := range 20 {
+		var pc parsedConfig
+		md, err := toml.Decode(config, &pc)
+		if err != nil {
+			t.Fatalf("config not decoded: %v", err)
+		}
+		_, err = configFromParsed(&pc, &md)
+		if err == nil {
+			t.Fatalf("invalid config accepted")
+		}
+		if i == 0 {
+			first = err.Error()
+		} else if err.Error() != first {
+			t.Fatalf("problems reported in different order:\n%v\n%v", first, err)
+		}
+	}
+	order := []int{}
+	for _, name := range []string{"profile a:", "profile b:", "user c:", "user d:"} {
+		order = append(order, strings.Index(first, name))
+	}
+	if !slices.IsSorted(order) || order[0] < 0 {
+		t.Errorf("problems are not sorted by name:\n%v", first)
+	}
+}
+
+func TestRootSocksReportedOnce(t *testing.T) {
+	config := `
+		listen_url = "0.0.0.0:6666"
+		socks5 = "proxy"
+		[users]
+		a = "dd000102030405060708090a0b0c0d0e0f"
+		b = "dd101112131415161718191a1b1c1d1e1f"
+		c = "dd202122232425262728292a2b2c2d2e2f"
+		[users.d]
+		secret = "dd303132333435363738393a3b3c3d3e3f"
+	`
+	var pc parsedConfig
+	md, err := toml.Decode(config, &pc)
+	if err != nil {
+		t.Fatalf("config not decoded: %v", err)
+	}
+	_, err = configFromParsed(&pc, &md)
+	if err == nil {
+		t.Fatalf("invalid root socks5 accepted")
+	}
+	if n := strings.Count(err.Error(), "socks5 must be host:port"); n != 1 {
+		t.Errorf("root socks5 reported %d times:\n%v", n, err)
+	}
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Amount of bytes. Can be specified in config as integer or as string with
+// binary suffix, e.g. "50GB" or "512K".
+type Size int64
+
+var sizeSuffixes = []struct {
+	suffix string
+	mult   int64
+}{
+	{"TB", 1 << 40}, {"T", 1 << 40},
+	{"GB", 1 << 30}, {"G", 1 << 30},
+	{"MB", 1 << 20}, {"M", 1 << 20},
+	{"KB", 1 << 10}, {"K", 1 << 10},
+	{"B", 1},
+}
+
+func ParseSize(s string) (Size, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, sfx := range sizeSuffixes {
+		if strings.HasSuffix(str, sfx.suffix) {
+			str = strings.TrimSpace(strings.TrimSuffix(str, sfx.suffix))
+			mult = sfx.mult
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return Size(value * float64(mult)), nil
+}
+
+func (s *Size) UnmarshalTOML(data any) error {
+	switch v := data.(type) {
+	case int64:
+		if v < 0 {
+			return fmt.Errorf("invalid size %d", v)
+		}
+		*s = Size(v)
+		return nil
+	case string:
+		size, err := ParseSize(v)
+		if err != nil {
+			return err
+		}
+		*s = size
+		return nil
+	default:
+		return fmt.Errorf("size must be integer or string")
+	}
+}
+
+// size in json is number of bytes or string as in toml
+func (s *Size) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	err := dec.Decode(&v)
+	if err != nil {
+		return err
+	}
+	if n, ok := v.(json.Number); ok {
+		v, err = n.Int64()
+		if err != nil {
+			return fmt.Errorf("invalid size %s", n)
+		}
+	}
+	return s.UnmarshalTOML(v)
+}
+
+func (s Size) String() string {
+	for _, sfx := range sizeSuffixes {
+		if len(sfx.suffix) == 2 && s >= Size(sfx.mult) && int64(s)%sfx.mult == 0 {
+			return fmt.Sprintf("%d%s", int64(s)/sfx.mult, sfx.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", int64(s))
+}
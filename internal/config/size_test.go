@@ -0,0 +1,34 @@
+package config
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	for str, expected := range map[string]Size{
+		"100":    100,
+		"10B":    10,
+		"512K":   512 << 10,
+		"50GB":   50 << 30,
+		"1.5 mb": 3 << 19,
+		"2T":     2 << 40,
+	} {
+		size, err := ParseSize(str)
+		if err != nil {
+			t.Errorf("size %s not parsed: %v", str, err)
+		}
+		if size != expected {
+			t.Errorf("size %s parsed as %d, expected %d", str, size, expected)
+		}
+	}
+	for _, str := range []string{"", "GB", "-1MB", "ten"} {
+		_, err := ParseSize(str)
+		if err == nil {
+			t.Errorf("invalid size %q parsed", str)
+		}
+	}
+}
+
+func TestSizeString(t *testing.T) {
+	if Size(50<<30).String() != "50GB" || Size(1000).String() != "1000B" {
+		t.Errorf("size formatted incorrectly")
+	}
+}
@@ -1,13 +1,156 @@
 package config
 
+import (
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/geovex/tgp/internal/stats"
+)
+
 type User struct {
-	Name        string
-	Secret      string
+	Name   string
+	Secret string
+	// secrets from secrets option, accepted together with Secret
+	Secrets []UserSecret
+	// profile with settings inherited before root section, empty if none
+	Profile     string
 	Obfuscate   *bool
 	AdTag       *string
 	Socks5      *string
 	Socks5_user *string
 	Socks5_pass *string
+	// traffic quota for period, 0 is unlimited
+	Quota       *Size
+	QuotaPeriod *stats.QuotaPeriod
+	// bytes per second shared by all sessions of user, 0 is unlimited
+	RateUp   *Size
+	RateDown *Size
+	// concurrent sessions and distinct client addresses, 0 is unlimited
+	MaxConnections *int
+	MaxIPs         *int
+	// user can't connect after expiry or while disabled
+	Expires  *time.Time
+	Disabled bool
+	// allowed client networks and dcs, empty means all
+	AllowIPs []netip.Prefix
+	AllowDCs []int16
+}
+
+// One of user's secrets, it isn't accepted after NotAfter
+type UserSecret struct {
+	Secret   string
+	NotAfter *time.Time
+	// name of secret in stats
+	Label string
+}
+
+// check if secret is accepted at time now
+func (s *UserSecret) Active(now time.Time) bool {
+	return s.NotAfter == nil || now.Before(*s.NotAfter)
+}
+
+// all secrets of user, secret option goes first with label "0"
+func (u *User) AllSecrets() []UserSecret {
+	if u.Secret == "" {
+		return u.Secrets
+	}
+	return append([]UserSecret{{Secret: u.Secret, Label: "0"}}, u.Secrets...)
+}
+
+// secrets accepted at time now
+func (u *User) ActiveSecrets(now time.Time) []UserSecret {
+	var secrets []UserSecret
+	for _, s := range u.AllSecrets() {
+		if s.Active(now) {
+			secrets = append(secrets, s)
+		}
+	}
+	return secrets
+}
+
+// fill unset settings from profile. Disabled profile disables its users.
+func (u *User) inherit(p *User) {
+	if u.Obfuscate == nil {
+		u.Obfuscate = p.Obfuscate
+	}
+	if u.AdTag == nil {
+		u.AdTag = p.AdTag
+	}
+	if u.Socks5 == nil {
+		u.Socks5 = p.Socks5
+	}
+	if u.Socks5_user == nil {
+		u.Socks5_user = p.Socks5_user
+	}
+	if u.Socks5_pass == nil {
+		u.Socks5_pass = p.Socks5_pass
+	}
+	if u.Quota == nil {
+		u.Quota = p.Quota
+	}
+	if u.QuotaPeriod == nil {
+		u.QuotaPeriod = p.QuotaPeriod
+	}
+	if u.RateUp == nil {
+		u.RateUp = p.RateUp
+	}
+	if u.RateDown == nil {
+		u.RateDown = p.RateDown
+	}
+	if u.MaxConnections == nil {
+		u.MaxConnections = p.MaxConnections
+	}
+	if u.MaxIPs == nil {
+		u.MaxIPs = p.MaxIPs
+	}
+	if u.Expires == nil {
+		u.Expires = p.Expires
+	}
+	u.Disabled = u.Disabled || p.Disabled
+	if u.AllowIPs == nil {
+		u.AllowIPs = p.AllowIPs
+	}
+	if u.AllowDCs == nil {
+		u.AllowDCs = p.AllowDCs
+	}
+}
+
+// check if client address is in allowed networks
+func (u *User) AllowsIP(ip netip.Addr) bool {
+	if len(u.AllowIPs) == 0 {
+		return true
+	}
+	ip = ip.Unmap()
+	for _, prefix := range u.AllowIPs {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// check if dc is allowed, media dcs (negative) are checked by their index
+func (u *User) AllowsDC(dc int16) bool {
+	if dc < 0 {
+		dc = -dc
+	}
+	return len(u.AllowDCs) == 0 || slices.Contains(u.AllowDCs, dc)
+}
+
+// reason why user can't connect at time now, empty if user is active
+func (u *User) InactiveReason(now time.Time) stats.CloseReason {
+	if u.Disabled {
+		return stats.ReasonUserDisabled
+	} else if u.Expires != nil && !now.Before(*u.Expires) {
+		return stats.ReasonUserExpired
+	}
+	return ""
+}
+
+// check if user may connect at time now
+func (u *User) Active(now time.Time) bool {
+	return u.InactiveReason(now) == ""
 }
 
 type userDB struct {
@@ -20,13 +163,11 @@ func NewUsers() *userDB {
 	}
 }
 
-func newOneUser(secret string, socks5 *string, user *string, pass *string) *userDB {
+// single user of root secret, its settings are inherited from root section
+func newOneUser(secret string) *userDB {
 	defuser := User{
-		Name:        "_",
-		Secret:      secret,
-		Socks5:      socks5,
-		Socks5_user: user,
-		Socks5_pass: pass,
+		Name:   "_",
+		Secret: secret,
 	}
 	users := NewUsers()
 	users.Users["_"] = &defuser
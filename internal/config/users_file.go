@@ -0,0 +1,254 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/geovex/tgp/internal/tgcrypt_encryption"
+)
+
+// size and modification time of users file when it was read
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// user read from users file with its line, 0 if line is unknown
+type fileEntry struct {
+	user *User
+	line int
+}
+
+// error of users file entry with file and line
+func entryError(path string, line int, name string, err error) error {
+	if line > 0 {
+		return fmt.Errorf("%s:%d: user %s: %w", path, line, name, err)
+	}
+	return fmt.Errorf("%s: user %s: %w", path, name, err)
+}
+
+// user record of jsonl users file
+type jsonUser struct {
+	Name string
+	parsedUserPrimitive
+}
+
+// read users file and merge its users with users from main config. Invalid
+// entries are skipped and kept in userErrors, returned error means file can't
+// be used at all.
+func (c *Config) loadUsersFile() error {
+	stamp, err := statFile(c.usersFile)
+	if err != nil {
+		return fmt.Errorf("can't read users file: %w", err)
+	}
+	data, err := os.ReadFile(c.usersFile)
+	if err != nil {
+		return fmt.Errorf("can't read users file: %w", err)
+	}
+	var entries []fileEntry
+	var errs []error
+	switch strings.ToLower(filepath.Ext(c.usersFile)) {
+	case ".jsonl", ".json":
+		entries, errs = readUsersJsonl(c.usersFile, data)
+	default:
+		entries, errs, err = readUsersToml(c.usersFile, data)
+		if err != nil {
+			return err
+		}
+	}
+	users := NewUsers()
+	keyOwners := map[string]string{}
+	for name, u := range c.inlineUsers.Users {
+		users.Users[name] = u
+		for _, s := range u.AllSecrets() {
+			if secret, err := tgcrypt_encryption.NewSecretHex(s.Secret); err == nil {
+				keyOwners[string(secret.RawSecret)] = name
+			}
+		}
+	}
+	for _, e := range entries {
+		u := e.user
+		if _, ok := users.Users[u.Name]; ok {
+			errs = append(errs, entryError(c.usersFile, e.line, u.Name, fmt.Errorf("duplicate user")))
+			continue
+		}
+		if err := c.checkFileUser(u); err != nil {
+			errs = append(errs, entryError(c.usersFile, e.line, u.Name, err))
+			continue
+		}
+		if owner := sharedSecretOwner(u, keyOwners); owner != "" {
+			errs = append(errs, entryError(c.usersFile, e.line, u.Name, fmt.Errorf("same secret as user %s", owner)))
+			continue
+		}
+		for _, s := range u.AllSecrets() {
+			// entries are validated, so secrets are valid
+			secret, _ := tgcrypt_encryption.NewSecretHex(s.Secret)
+			keyOwners[string(secret.RawSecret)] = u.Name
+		}
+		users.Users[u.Name] = u
+	}
+	c.users = users
+	c.usersFileStamp = stamp
+	c.userErrors = errs
+	return nil
+}
+
+// owner of key of one of user's secrets, empty if keys are not used
+func sharedSecretOwner(u *User, keyOwners map[string]string) string {
+	for _, s := range u.AllSecrets() {
+		secret, _ := tgcrypt_encryption.NewSecretHex(s.Secret)
+		if owner, ok := keyOwners[string(secret.RawSecret)]; ok {
+			return owner
+		}
+	}
+	return ""
+}
+
+// users of toml file, top level keys are user names with same syntax as in
+// users section of main config
+func readUsersToml(path string, data []byte) ([]fileEntry, []error, error) {
+	var parsed map[string]toml.Primitive
+	md, err := toml.Decode(string(data), &parsed)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't parse users file: %w", err)
+	}
+	entryErrs := map[string]error{}
+	decoded := map[string]*User{}
+	for name, prim := range parsed {
+		var u User
+		switch md.Type(name) {
+		case "String":
+			u.Name = name
+			err = md.PrimitiveDecode(prim, &u.Secret)
+			if err == nil {
+				u.Secret, err = expandEnv("secret", u.Secret)
+			}
+		case "Hash":
+			var pu parsedUserPrimitive
+			err = md.PrimitiveDecode(prim, &pu)
+			if err == nil {
+				u, err = userFromParsed(name, &pu)
+			}
+		default:
+			err = fmt.Errorf("unknown type %s", md.Type(name))
+		}
+		if err == nil {
+			err = checkEntry(&u)
+		}
+		if err != nil {
+			entryErrs[name] = err
+			continue
+		}
+		decoded[name] = &u
+	}
+	for _, key := range md.Undecoded() {
+		name := key[0]
+		if _, ok := entryErrs[name]; !ok {
+			entryErrs[name] = fmt.Errorf("unknown option %s", key[1:])
+			delete(decoded, name)
+		}
+	}
+	var users []fileEntry
+	for _, name := range slices.Sorted(maps.Keys(decoded)) {
+		users = append(users, fileEntry{decoded[name], tomlKeyLine(data, name)})
+	}
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(entryErrs)) {
+		errs = append(errs, entryError(path, tomlKeyLine(data, name), name, entryErrs[name]))
+	}
+	return users, errs, nil
+}
+
+// line of toml key or table header, 0 if it's not found
+func tomlKeyLine(data []byte, name string) int {
+	keys := []string{name, strconv.Quote(name), "'" + name + "'"}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		for _, key := range keys {
+			if line == "["+key+"]" || strings.HasPrefix(line, key+" ") || strings.HasPrefix(line, key+"=") {
+				return i + 1
+			}
+		}
+	}
+	return 0
+}
+
+// users of jsonl file, one json object with name and user options per line
+func readUsersJsonl(path string, data []byte) ([]fileEntry, []error) {
+	var users []fileEntry
+	var errs []error
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var ju jsonUser
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&ju)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %w", path, lineNum, err))
+			continue
+		}
+		if ju.Name == "" {
+			errs = append(errs, fmt.Errorf("%s:%d: user name is empty", path, lineNum))
+			continue
+		}
+		u, err := userFromParsed(ju.Name, &ju.parsedUserPrimitive)
+		if err == nil {
+			err = checkEntry(&u)
+		}
+		if err == nil && seen[u.Name] {
+			err = fmt.Errorf("duplicate user")
+		}
+		if err != nil {
+			errs = append(errs, entryError(path, lineNum, ju.Name, err))
+			continue
+		}
+		seen[u.Name] = true
+		users = append(users, fileEntry{&u, lineNum})
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %w", path, err))
+	}
+	return users, errs
+}
+
+// users file entries are validated one by one, invalid ones are skipped.
+// Settings of entry itself are checked on reading.
+func checkEntry(u *User) error {
+	if err := checkSecrets(u); err != nil {
+		return fmt.Errorf("invalid secret: %w", err)
+	}
+	return checkUserSocks(u)
+}
+
+// check entry with settings inherited from profile and root section
+func (c *Config) checkFileUser(u *User) error {
+	if err := c.checkProfile(u); err != nil {
+		return err
+	}
+	resolved := c.resolveUser(u)
+	return checkUser(&resolved)
+}
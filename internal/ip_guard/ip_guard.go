@@ -0,0 +1,199 @@
+// Per source ip connection limits and temporary bans for clients failing
+// authentication.
+package ip_guard
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits for single ip. Zero values disable corresponding limit.
+type Limits struct {
+	// concurrent connections
+	MaxConnections int
+	// new connections per minute
+	HandshakesPerMinute int
+	// number of failed handshakes within BanWindow to ban ip
+	BanFailures int
+	BanWindow   time.Duration
+	BanTTL      time.Duration
+}
+
+type Verdict uint8
+
+const (
+	Allowed Verdict = iota
+	// ip is temporarily banned
+	Banned
+	// connection or handshake rate limit exceeded
+	Limited
+)
+
+const cleanupInterval = time.Minute
+
+type ipState struct {
+	connections int
+	// handshake rate window
+	rateStart time.Time
+	rateCount int
+	// failures window
+	failStart   time.Time
+	failCount   int
+	bannedUntil time.Time
+}
+
+// Banned ip description
+type Ban struct {
+	IP    netip.Addr `json:"ip"`
+	Until time.Time  `json:"until"`
+}
+
+type Guard struct {
+	lock        sync.Mutex
+	limits      Limits
+	ips         map[netip.Addr]*ipState
+	nextCleanup time.Time
+	now         func() time.Time
+}
+
+func New(limits Limits) *Guard {
+	return &Guard{
+		limits: limits,
+		ips:    map[netip.Addr]*ipState{},
+		now:    time.Now,
+	}
+}
+
+// replace limits (on config reload). Existing bans are kept.
+func (g *Guard) SetLimits(limits Limits) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.limits = limits
+}
+
+func (g *Guard) state(ip netip.Addr) *ipState {
+	st, ok := g.ips[ip]
+	if !ok {
+		st = &ipState{}
+		g.ips[ip] = st
+	}
+	return st
+}
+
+// check new connection from ip. Allowed connection must be released with
+// Release when it's closed.
+func (g *Guard) Admit(ip netip.Addr) Verdict {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	now := g.now()
+	g.cleanup(now)
+	st := g.state(ip)
+	if now.Before(st.bannedUntil) {
+		return Banned
+	}
+	if g.limits.MaxConnections > 0 && st.connections >= g.limits.MaxConnections {
+		return Limited
+	}
+	if g.limits.HandshakesPerMinute > 0 {
+		if now.Sub(st.rateStart) >= time.Minute {
+			st.rateStart = now
+			st.rateCount = 0
+		}
+		if st.rateCount >= g.limits.HandshakesPerMinute {
+			return Limited
+		}
+		st.rateCount++
+	}
+	st.connections++
+	return Allowed
+}
+
+// connection from ip is closed
+func (g *Guard) Release(ip netip.Addr) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	st, ok := g.ips[ip]
+	if ok && st.connections > 0 {
+		st.connections--
+	}
+}
+
+// register failed handshake, ip is banned after too many failures. Returns
+// true if ip became banned.
+func (g *Guard) Fail(ip netip.Addr) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.limits.BanFailures <= 0 || g.limits.BanTTL <= 0 {
+		return false
+	}
+	now := g.now()
+	st := g.state(ip)
+	if g.limits.BanWindow > 0 && now.Sub(st.failStart) >= g.limits.BanWindow {
+		st.failStart = now
+		st.failCount = 0
+	}
+	st.failCount++
+	if st.failCount >= g.limits.BanFailures {
+		st.failCount = 0
+		st.bannedUntil = now.Add(g.limits.BanTTL)
+		return true
+	}
+	return false
+}
+
+// remove ban for ip. Returns false if ip was not banned.
+func (g *Guard) Unban(ip netip.Addr) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	st, ok := g.ips[ip]
+	if !ok || !g.now().Before(st.bannedUntil) {
+		return false
+	}
+	st.bannedUntil = time.Time{}
+	return true
+}
+
+// list of currently banned ips sorted by address
+func (g *Guard) Bans() []Ban {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	now := g.now()
+	bans := []Ban{}
+	for ip, st := range g.ips {
+		if now.Before(st.bannedUntil) {
+			bans = append(bans, Ban{IP: ip, Until: st.bannedUntil})
+		}
+	}
+	slices.SortFunc(bans, func(a, b Ban) int { return a.IP.Compare(b.IP) })
+	return bans
+}
+
+func (g *Guard) AsString() string {
+	b := &strings.Builder{}
+	bans := g.Bans()
+	fmt.Fprintf(b, "Bans: %d\n", len(bans))
+	for _, ban := range bans {
+		fmt.Fprintf(b, "%s until %s\n", ban.IP, ban.Until.UTC().Format(time.RFC3339))
+	}
+	return b.String()
+}
+
+// drop state of idle ips. Must be called with lock held.
+func (g *Guard) cleanup(now time.Time) {
+	if now.Before(g.nextCleanup) {
+		return
+	}
+	g.nextCleanup = now.Add(cleanupInterval)
+	for ip, st := range g.ips {
+		if st.connections == 0 &&
+			!now.Before(st.bannedUntil) &&
+			now.Sub(st.rateStart) >= time.Minute &&
+			(g.limits.BanWindow <= 0 || now.Sub(st.failStart) >= g.limits.BanWindow) {
+			delete(g.ips, ip)
+		}
+	}
+}
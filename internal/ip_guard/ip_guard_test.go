@@ -0,0 +1,87 @@
+package ip_guard
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// guard with controllable clock
+func newTestGuard(limits Limits) (*Guard, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	g := New(limits)
+	g.now = func() time.Time { return now }
+	return g, &now
+}
+
+func TestMaxConnections(t *testing.T) {
+	g, _ := newTestGuard(Limits{MaxConnections: 2})
+	ip := netip.MustParseAddr("10.0.0.1")
+	if g.Admit(ip) != Allowed || g.Admit(ip) != Allowed {
+		t.Fatalf("connections under limit not allowed")
+	}
+	if g.Admit(ip) != Limited {
+		t.Errorf("connection over limit allowed")
+	}
+	if g.Admit(netip.MustParseAddr("10.0.0.2")) != Allowed {
+		t.Errorf("limit applied to other ip")
+	}
+	g.Release(ip)
+	if g.Admit(ip) != Allowed {
+		t.Errorf("released connection not allowed")
+	}
+}
+
+func TestHandshakeRate(t *testing.T) {
+	g, now := newTestGuard(Limits{HandshakesPerMinute: 2})
+	ip := netip.MustParseAddr("10.0.0.1")
+	for i := 0; i < 2; i++ {
+		if g.Admit(ip) != Allowed {
+			t.Fatalf("handshake %d not allowed", i)
+		}
+		g.Release(ip)
+	}
+	if g.Admit(ip) != Limited {
+		t.Errorf("handshake over rate allowed")
+	}
+	*now = now.Add(time.Minute)
+	if g.Admit(ip) != Allowed {
+		t.Errorf("handshake in new window not allowed")
+	}
+}
+
+func TestBan(t *testing.T) {
+	g, now := newTestGuard(Limits{BanFailures: 3, BanWindow: time.Minute, BanTTL: 10 * time.Minute})
+	ip := netip.MustParseAddr("10.0.0.1")
+	g.Fail(ip)
+	g.Fail(ip)
+	*now = now.Add(2 * time.Minute)
+	g.Fail(ip)
+	if g.Admit(ip) != Allowed {
+		t.Fatalf("failures outside window caused ban")
+	}
+	g.Fail(ip)
+	if !g.Fail(ip) {
+		t.Fatalf("ip not banned")
+	}
+	if g.Admit(ip) != Banned {
+		t.Errorf("banned ip allowed")
+	}
+	bans := g.Bans()
+	if len(bans) != 1 || bans[0].IP != ip {
+		t.Errorf("wrong ban list: %v", bans)
+	}
+	*now = now.Add(11 * time.Minute)
+	if g.Admit(ip) != Allowed || len(g.Bans()) != 0 {
+		t.Errorf("ban not expired")
+	}
+}
+
+func TestUnban(t *testing.T) {
+	g, _ := newTestGuard(Limits{BanFailures: 1, BanTTL: time.Minute})
+	ip := netip.MustParseAddr("10.0.0.1")
+	g.Fail(ip)
+	if !g.Unban(ip) || g.Admit(ip) != Allowed {
+		t.Errorf("ip not unbanned")
+	}
+}
@@ -6,7 +6,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"net/netip"
+	"slices"
+	"time"
 
 	"github.com/geovex/tgp/internal/config"
 	"github.com/geovex/tgp/internal/stats"
@@ -17,26 +21,124 @@ type ClientHandler struct {
 	statsHandle *stats.StatsHandle
 	client      net.Conn
 	config      *config.Config
+	listener    *config.Listener
+	// called on failed handshake
+	onAuthFail func()
+	// logger with connection fields, user fields are added after handshake
+	log *slog.Logger
 	// available after handshake
 	user      *config.User
 	cliCtx    *tgcrypt_encryption.ObfCtx
 	cliStream dataStream
 }
 
-func NewClient(cfg *config.Config, statsHandle *stats.StatsHandle, client net.Conn) *ClientHandler {
+func NewClient(cfg *config.Config, listener *config.Listener, statsHandle *stats.StatsHandle, client net.Conn) *ClientHandler {
 	return &ClientHandler{
 		statsHandle: statsHandle,
 		config:      cfg,
+		listener:    listener,
 		client:      client,
+		log: slog.With(
+			"conn", statsHandle.ID(),
+			"remote", client.RemoteAddr().String(),
+			"listener", listener.String()),
 	}
 }
 
+// name of client protocol for logs
+func protocolName(protocol uint8) string {
+	switch protocol {
+	case tgcrypt_encryption.Abridged:
+		return "abridged"
+	case tgcrypt_encryption.Intermediate:
+		return "intermediate"
+	case tgcrypt_encryption.Padded:
+		return "padded"
+	case tgcrypt_encryption.Full:
+		return "full"
+	default:
+		return fmt.Sprintf("unknown(%x)", protocol)
+	}
+}
+
+func (c *ClientHandler) logDisconnect(err error) {
+	if err != nil {
+		c.log.Info("client disconnected", "error", err)
+	} else {
+		c.log.Info("client disconnected")
+	}
+}
+
+// set function called when client fails handshake
+func (c *ClientHandler) SetAuthFailHandler(fn func()) {
+	c.onAuthFail = fn
+}
+
+func (c *ClientHandler) authFailed() {
+	if c.onAuthFail != nil {
+		c.onAuthFail()
+	}
+}
+
+// redirect banned client to fallback host without handshake
+func (c *ClientHandler) HandleBanned() error {
+	defer c.client.Close()
+	defer c.statsHandle.Close()
+	c.statsHandle.SetCloseReason(stats.ReasonBanned)
+	c.log.Debug("banned client")
+	return c.handleFallBack(nil)
+}
+
+// iterate resolved active users allowed on client's listener. Expired and
+// disabled users are skipped, so their clients are handled like unknown ones.
+func (c *ClientHandler) iterateUsers() func(func(string, config.User) bool) {
+	now := time.Now()
+	users := c.config.IterateUsers()
+	if len(c.listener.Users) > 0 {
+		users = slices.Values(c.listener.Users)
+	}
+	return func(fn func(string, config.User) bool) {
+		for name := range users {
+			// listener may come from older config
+			u, err := c.config.GetUser(name)
+			if err != nil || !u.Active(now) {
+				continue
+			}
+			if !fn(name, u) {
+				return
+			}
+		}
+	}
+}
+
+// fallback host of client's listener or global one
+func (c *ClientHandler) fallbackHost() *string {
+	if c.listener.Host == nil {
+		return c.config.GetHost()
+	} else if *c.listener.Host == "" {
+		return nil
+	}
+	return c.listener.Host
+}
+
 func (c *ClientHandler) HandleClient() (err error) {
 	defer c.client.Close()
 	defer c.statsHandle.Close()
+	handshakeTimeout := c.config.GetTimeouts().Handshake
+	if handshakeTimeout > 0 {
+		c.client.SetDeadline(time.Now().Add(handshakeTimeout))
+	}
 	var initialPacket tgcrypt_encryption.Nonce
 	n, err := io.ReadFull(c.client, initialPacket[:])
 	if err != nil {
+		if isTimeout(err) {
+			return c.handshakeFailed(err)
+		}
+		// connections closed without data (like tcp health checks) are
+		// not failed handshakes
+		if n > 0 {
+			c.authFailed()
+		}
 		return c.handleFallBack(initialPacket[:n])
 	}
 	//check for tls in handshake
@@ -47,50 +149,171 @@ func (c *ClientHandler) HandleClient() (err error) {
 	}
 }
 
+// record handshake timeout if it caused error
+func (c *ClientHandler) handshakeFailed(err error) error {
+	if isTimeout(err) {
+		c.statsHandle.SetCloseReason(stats.ReasonHandshakeTimeout)
+		c.authFailed()
+	}
+	return err
+}
+
+// record dc connect failure reason
+func (c *ClientHandler) connectFailed(err error) error {
+	if isTimeout(err) {
+		c.statsHandle.SetCloseReason(stats.ReasonDcConnectTimeout)
+	} else {
+		c.statsHandle.SetCloseReason(stats.ReasonDcError)
+	}
+	return err
+}
+
+// record failed connection to dc or middle proxy
+func (c *ClientHandler) dcConnectFailed(err error) error {
+	c.statsHandle.CountConnectError()
+	return c.connectFailed(err)
+}
+
+func (c *ClientHandler) relayOptions() relayOptions {
+	opts := relayOptions{
+		idle:    c.config.GetTimeouts().Idle,
+		traffic: c.statsHandle,
+	}
+	if c.user != nil {
+		opts.addLimits(
+			limiters.Get(limiterKey{user: c.user.Name, up: true}, int64(*c.user.RateUp)),
+			limiters.Get(limiterKey{user: c.user.Name}, int64(*c.user.RateDown)))
+	}
+	global := c.config.GetGlobalRate()
+	opts.addLimits(
+		limiters.Get(limiterKey{global: true, up: true}, int64(global.Up)),
+		limiters.Get(limiterKey{global: true}, int64(global.Down)))
+	return opts
+}
+
+// record idle timeout if relay was stopped by it
+func (c *ClientHandler) relayDone(err error) {
+	if errors.Is(err, errIdleTimeout) {
+		c.statsHandle.SetCloseReason(stats.ReasonIdleTimeout)
+	}
+}
+
 var errNoFallbackHost = errors.New("no fallback host")
 
+func userLimits(u *config.User) stats.UserLimits {
+	return stats.UserLimits{
+		Quota:          uint64(*u.Quota),
+		QuotaPeriod:    *u.QuotaPeriod,
+		MaxConnections: *u.MaxConnections,
+		MaxIPs:         *u.MaxIPs,
+	}
+}
+
+// authorize matched user if client is allowed and session is within user's
+// limits. Client's dc must be known. Refused client is closed, or redirected
+// to fallback host if quota_action says so and handshake is given. Returns
+// false if session must not continue.
+func (c *ClientHandler) authorizeUser(u *config.User, handshake []byte) (bool, error) {
+	if err := c.checkAllowed(u); err != nil {
+		return false, err
+	}
+	return c.refused(u, c.statsHandle.Authorize(u.Name, userLimits(u)), handshake)
+}
+
+// check matched user like authorizeUser, but without authorization. Used by
+// faketls before server hello, while client's dc is still unknown.
+func (c *ClientHandler) checkUser(u *config.User, handshake []byte) (bool, error) {
+	if err := c.checkAllowed(u); err != nil {
+		return false, err
+	}
+	return c.refused(u, c.statsHandle.CheckLimits(u.Name, userLimits(u)), handshake)
+}
+
+// handle refusal reason of authorization
+func (c *ClientHandler) refused(u *config.User, reason stats.CloseReason, handshake []byte) (bool, error) {
+	if reason == "" {
+		return true, nil
+	}
+	c.log.Info("user refused", "user", u.Name, "reason", reason)
+	if reason == stats.ReasonQuotaExceeded && c.config.GetQuotaFallback() && handshake != nil {
+		return false, c.handleFallBack(handshake)
+	}
+	return false, fmt.Errorf("user %s refused: %s", u.Name, reason)
+}
+
 // redirect connection to fallback host in case of failed authentication
 func (c *ClientHandler) handleFallBack(initialPacket []byte) (err error) {
 	defer c.client.Close()
-	if c.config.GetHost() == nil {
+	fallbackHost := c.fallbackHost()
+	if fallbackHost == nil {
 		return errNoFallbackHost
 	}
 	c.statsHandle.SetState(stats.Fallback)
-	fmt.Printf("redirect conection to fake host\n")
+	c.client.SetDeadline(time.Time{})
+	c.log.Info("redirect to fallback host", "host", *fallbackHost)
+	timeouts := c.config.GetTimeouts()
 	sa, su, sp := c.config.GetDefaultSocks()
-	dc, err := dcConnectorFromSocks(su, sa, sp, c.config.GetAllowIPv6())
+	dc, err := dcConnectorFromSocks(sa, su, sp, c.config.GetAllowIPv6(), timeouts.DcConnect)
 	if err != nil {
 		return
 	}
-	host, err := dc.ConnectHost(*c.config.GetHost())
+	host, err := dc.ConnectHost(*fallbackHost)
 	if err != nil {
-		return
+		return c.connectFailed(err)
 	}
 	defer host.Close()
-	_, err = host.Write(initialPacket)
-	if err != nil {
-		return
+	if len(initialPacket) > 0 {
+		_, err = host.Write(initialPacket)
+		if err != nil {
+			return
+		}
 	}
-	transceiveStreams(c.client, host)
+	errc, _ := transceiveStreams(c.client, host, c.relayOptions())
+	c.relayDone(errc)
 	return nil
 }
 
-func (c *ClientHandler) processWithConfig() (err error) {
-	s, ok := c.client.(*net.TCPConn)
-	if !ok {
-		panic("not a TCP connection")
+// check client address and dc, if it's already known, against user's allow
+// lists. Clients without ip address (unix sockets) are refused if allow_ips is
+// set.
+func (c *ClientHandler) checkAllowed(u *config.User) error {
+	if len(u.AllowIPs) > 0 {
+		addr, err := netip.ParseAddrPort(c.client.RemoteAddr().String())
+		if err != nil || !u.AllowsIP(addr.Addr()) {
+			c.statsHandle.Refuse(u.Name, stats.ReasonIPNotAllowed)
+			return fmt.Errorf("user %s refused: client address %s not allowed", u.Name, c.client.RemoteAddr())
+		}
+	}
+	if c.cliCtx != nil && !u.AllowsDC(c.cliCtx.Dc) {
+		c.statsHandle.Refuse(u.Name, stats.ReasonDcNotAllowed)
+		return fmt.Errorf("user %s refused: dc %d not allowed", u.Name, c.cliCtx.Dc)
 	}
-	c.statsHandle.SetConnected(s)
+	return nil
+}
+
+func (c *ClientHandler) processWithConfig() (err error) {
+	// handshake is complete
+	c.client.SetDeadline(time.Time{})
+	c.statsHandle.SetConnected(c.client)
+	timeouts := c.config.GetTimeouts()
 	var flags = stats.ConnectionFlags{}
 	if c.user.AdTag == nil { // no intermidiate proxy required
-		dcConector, err := dcConnectorFromSocks(c.user.Socks5, c.user.Socks5_user, c.user.Socks5_pass, c.config.GetAllowIPv6())
+		dcConector, err := dcConnectorFromSocks(c.user.Socks5, c.user.Socks5_user, c.user.Socks5_pass, c.config.GetAllowIPv6(), timeouts.DcConnect)
 		if err != nil {
 			return err
 		}
+		egress := "direct"
+		if c.user.Socks5 != nil {
+			egress = "socks"
+		}
+		c.log = c.log.With("egress", egress)
+		c.statsHandle.SetEgress(egress)
+		connectStart := time.Now()
 		sock, err := dcConector.ConnectDC(c.cliCtx.Dc)
 		if err != nil {
-			return fmt.Errorf("can't connect to DC %d: %w", c.cliCtx.Dc, err)
+			return c.dcConnectFailed(fmt.Errorf("can't connect to DC %d: %w", c.cliCtx.Dc, err))
 		}
+		c.statsHandle.ObserveConnect(time.Since(connectStart))
 		var dcStream dataStream
 		if c.user.Obfuscate != nil && *c.user.Obfuscate {
 			dcCtx := tgcrypt_encryption.DcCtxNew(c.cliCtx.Dc, c.cliCtx.Protocol)
@@ -100,24 +323,31 @@ func (c *ClientHandler) processWithConfig() (err error) {
 			dcStream = LoginDC(sock, c.cliCtx.Protocol)
 		}
 		defer dcStream.Close()
-		transceiveDataStreams(c.cliStream, dcStream)
+		errc, _ := transceiveDataStreams(c.cliStream, dcStream, c.relayOptions())
+		c.relayDone(errc)
 	} else {
+		c.log = c.log.With("egress", "middle")
+		c.statsHandle.SetEgress("middle")
 		mpm, err := getMiddleProxyManager(c.config)
 		if err != nil {
-			return err
+			return c.dcConnectFailed(err)
 		}
 		adTag, err := hex.DecodeString(*c.user.AdTag)
 		if err != nil {
 			return fmt.Errorf("can't decode adTag (%s): %w", *c.user.AdTag, err)
 		}
-		middleProxyStream, err := mpm.connect(c.cliCtx.Dc, c.client, c.cliCtx.Protocol, adTag)
+		connectStart := time.Now()
+		middleProxyStream, err := mpm.connect(c.cliCtx.Dc, c.client, c.cliCtx.Protocol, adTag, timeouts.DcConnect)
 		if err != nil {
-			return fmt.Errorf("can't connect to middle proxy: %w", err)
+			return c.dcConnectFailed(fmt.Errorf("can't connect to middle proxy: %w", err))
 		}
+		c.statsHandle.ObserveConnect(time.Since(connectStart))
+		c.statsHandle.ObserveMiddleLogin(middleProxyStream.loginTime)
 		defer middleProxyStream.CloseStream()
 		clientMsgStream := newMsgStream(c.cliStream)
 		flags.MiddleProxy = true
-		transceiveMsg(clientMsgStream, middleProxyStream)
+		errc, _ := transceiveMsg(clientMsgStream, middleProxyStream, c.relayOptions())
+		c.relayDone(errc)
 	}
 	c.statsHandle.OrFlags(flags)
 	return nil
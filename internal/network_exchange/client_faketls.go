@@ -23,33 +23,40 @@ func (o *ClientHandler) handleFakeTls(initialPacket [tgcrypt_encryption.NonceSiz
 	_, err = io.ReadFull(o.client, tlsHandshake[tgcrypt_encryption.NonceSize:])
 	var clientCtx *tgcrypt_encryption.FakeTlsCtx
 	if err != nil {
-		return
+		return o.handshakeFailed(err)
 	}
-	for name := range o.config.IterateUsers() {
+	var secretLabel string
+	matchStart := time.Now()
+users:
+	for _, u := range o.iterateUsers() {
 		runtime.Gosched()
-		u, err := o.config.GetUser(name)
-		if err != nil {
-			panic("invalid name in user iteration")
-		}
-		userSecret, err := tgcrypt_encryption.NewSecretHex(u.Secret)
-		if err != nil {
-			continue
-		}
-		clientCtx, err = tgcrypt_encryption.FakeTlsCtxFromTlsHeader(tlsHandshake, userSecret)
-		if err != nil {
-			continue
-		} else {
-			o.user = &u
-			fmt.Printf("Client connected %s (faketls)\n", u.Name)
-			break
+		for _, s := range u.ActiveSecrets(matchStart) {
+			userSecret, err := tgcrypt_encryption.NewSecretHex(s.Secret)
+			if err != nil {
+				continue
+			}
+			clientCtx, err = tgcrypt_encryption.FakeTlsCtxFromTlsHeader(tlsHandshake, userSecret)
+			if err != nil {
+				continue
+			} else {
+				o.user = &u
+				secretLabel = s.Label
+				break users
+			}
 		}
 	}
+	o.statsHandle.ObserveHandshake(time.Since(matchStart))
 	if o.user == nil {
+		o.authFailed()
 		return o.handleFallBack(tlsHandshake[:])
 	}
-	o.statsHandle.SetAuthorized(o.user.Name)
+	o.statsHandle.SetSecret(secretLabel)
+	if ok, err := o.checkUser(o.user, tlsHandshake[:]); !ok {
+		return err
+	}
+	o.log = o.log.With("user", o.user.Name, "secret", secretLabel, "transport", "faketls")
 	err = o.transceiveFakeTls(clientCtx)
-	fmt.Printf("Client disconnected %s (faketls) \n", o.user.Name)
+	o.logDisconnect(err)
 	return err
 }
 
@@ -113,22 +120,28 @@ func (o *ClientHandler) transceiveFakeTls(cryptClient *tgcrypt_encryption.FakeTl
 	copy(toClientHelloPkt[11:], toClientDigest)
 	_, err = o.client.Write(toClientHelloPkt)
 	if err != nil {
-		return err
+		return o.handshakeFailed(err)
 	}
 	fts := newFakeTlsStream(o.client)
 	var simpleHeader [tgcrypt_encryption.NonceSize]byte
 	_, err = io.ReadFull(fts, simpleHeader[:])
 	if err != nil {
-		return fmt.Errorf("can't read inner simple header: %w", err)
+		return o.handshakeFailed(fmt.Errorf("can't read inner simple header: %w", err))
 	}
 	o.cliCtx, err = tgcrypt_encryption.ObfCtxFromNonce(simpleHeader, cryptClient.Secret)
 	if err != nil {
 		return fmt.Errorf("can't create simple ctx from inner simple header: %w", err)
 	}
 	o.cliStream = newObfuscatedStream(fts, o.cliCtx, &o.cliCtx.Nonce, o.cliCtx.Protocol)
-	err = o.processWithConfig()
-	fmt.Printf("Client disconnected %s (faketls)\n", o.user.Name)
-	return err
+	o.log = o.log.With("protocol", protocolName(o.cliCtx.Protocol), "dc", o.cliCtx.Dc)
+	o.statsHandle.SetSession("faketls", protocolName(o.cliCtx.Protocol), o.cliCtx.Dc)
+	// server hello is sent, so refused client can't be redirected to
+	// fallback host
+	if ok, err := o.authorizeUser(o.user, nil); !ok {
+		return err
+	}
+	o.log.Info("client connected")
+	return o.processWithConfig()
 }
 
 type fakeTlsStream struct {
@@ -1,8 +1,8 @@
 package network_exchange
 
 import (
-	"fmt"
 	"runtime"
+	"time"
 
 	"github.com/geovex/tgp/internal/config"
 	"github.com/geovex/tgp/internal/stats"
@@ -10,49 +10,58 @@ import (
 )
 
 func (o *ClientHandler) handleObfClient(initialPacket [tgcrypt_encryption.NonceSize]byte) (err error) {
-	var user *string
-	for name := range o.config.IterateUsers() {
+	var user *config.User
+	var secretLabel string
+	matchStart := time.Now()
+users:
+	for _, u := range o.iterateUsers() {
 		runtime.Gosched()
-		u, err := o.config.GetUser(name)
-		if err != nil {
-			panic("invalid name in user iteration")
-		}
 		if tgcrypt_encryption.IsWrongNonce(initialPacket) {
 			continue
 		}
-		userSecret, err := tgcrypt_encryption.NewSecretHex(u.Secret)
-		if err != nil {
-			continue
-		}
-		o.cliCtx, err = tgcrypt_encryption.ObfCtxFromNonce(initialPacket, userSecret)
-		if err != nil {
-			continue
-		}
-		// basic afterchecks
-		if o.cliCtx.Dc > tgcrypt_encryption.DcMaxIdx || o.cliCtx.Dc < -tgcrypt_encryption.DcMaxIdx || o.cliCtx.Dc == 0 {
-			continue
+		for _, s := range u.ActiveSecrets(matchStart) {
+			userSecret, err := tgcrypt_encryption.NewSecretHex(s.Secret)
+			if err != nil {
+				continue
+			}
+			o.cliCtx, err = tgcrypt_encryption.ObfCtxFromNonce(initialPacket, userSecret)
+			if err != nil {
+				continue
+			}
+			// basic afterchecks
+			if o.cliCtx.Dc > tgcrypt_encryption.DcMaxIdx || o.cliCtx.Dc < -tgcrypt_encryption.DcMaxIdx || o.cliCtx.Dc == 0 {
+				continue
+			}
+			user = &u
+			secretLabel = s.Label
+			break users
 		}
-		user = &u.Name
-		fmt.Printf("Client connected %s, protocol: %x\n", *user, o.cliCtx.Protocol)
-		break
 	}
+	o.statsHandle.ObserveHandshake(time.Since(matchStart))
 	if user == nil {
+		o.authFailed()
 		return o.handleFallBack(initialPacket[:])
 	}
-	o.statsHandle.SetAuthorized(*user)
-	//connect to dc
-	var u config.User
-	u, err = o.config.GetUser(*user)
-	if err != nil {
-		panic("user found, but GetUser failed")
+	o.statsHandle.SetSecret(secretLabel)
+	if ok, err := o.authorizeUser(user, initialPacket[:]); !ok {
+		return err
 	}
-	o.user = &u
+	o.log = o.log.With(
+		"user", user.Name,
+		"secret", secretLabel,
+		"transport", "obfuscated",
+		"protocol", protocolName(o.cliCtx.Protocol),
+		"dc", o.cliCtx.Dc)
+	o.statsHandle.SetSession("obfuscated", protocolName(o.cliCtx.Protocol), o.cliCtx.Dc)
+	o.log.Info("client connected")
+	//connect to dc
+	o.user = user
 	var flags = stats.ConnectionFlags{
 		Obfuscated: true,
 	}
 	o.statsHandle.OrFlags(flags)
 	o.cliStream = newObfuscatedStream(o.client, o.cliCtx, nil, o.cliCtx.Protocol)
 	err = o.processWithConfig()
-	fmt.Printf("Client disconnected %s\n", o.user.Name)
+	o.logDisconnect(err)
 	return
 }
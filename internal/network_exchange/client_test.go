@@ -0,0 +1,99 @@
+package network_exchange
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/geovex/tgp/internal/config"
+	"github.com/geovex/tgp/internal/stats"
+)
+
+// handler of one end of pipe, other end is returned as client
+func testClient(t *testing.T, text string) (*ClientHandler, *stats.Stats, net.Conn) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tgp.toml")
+	if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := config.ReadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &c.GetListeners()[0]
+	s := stats.New()
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	return NewClient(c, listener, s.AllocClient(server, listener.String()), server), s, client
+}
+
+// run client handler and wait until it's done
+func handle(t *testing.T, h *ClientHandler, timeout time.Duration) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		h.HandleClient()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatalf("client not closed in %s", timeout)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	h, s, client := testClient(t, `
+		listen_url = "127.0.0.1:6666"
+		handshake_timeout = "100ms"
+		[users]
+		1 = "dd000102030405060708090a0b0c0d0e0f"
+	`)
+	failures := 0
+	h.SetAuthFailHandler(func() { failures++ })
+	go client.Write(make([]byte, 10))
+	handle(t, h, 2*time.Second)
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("stalled client not disconnected: %v", err)
+	}
+	if closed := s.Summary().Closed[stats.ReasonHandshakeTimeout]; closed != 1 {
+		t.Errorf("handshake timeout not recorded: %v", s.Summary().Closed)
+	}
+	if failures != 1 {
+		t.Errorf("handshake timeout counted as %d failures", failures)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	// silent fallback host
+	host, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	go func() {
+		for {
+			conn, err := host.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	h, s, client := testClient(t, `
+		listen_url = "127.0.0.1:6666"
+		host = "`+host.Addr().String()+`"
+		idle_timeout = "100ms"
+		[users]
+		1 = "dd000102030405060708090a0b0c0d0e0f"
+	`)
+	// unknown client is relayed to fallback host, which never answers
+	go client.Write(make([]byte, 64))
+	handle(t, h, 2*time.Second)
+	if closed := s.Summary().Closed[stats.ReasonIdleTimeout]; closed != 1 {
+		t.Errorf("idle timeout not recorded: %v", s.Summary().Closed)
+	}
+}
@@ -1,9 +1,12 @@
 package network_exchange
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"time"
 
 	"github.com/geovex/tgp/internal/tgcrypt_encryption"
 	"golang.org/x/net/proxy"
@@ -20,14 +23,16 @@ type DCConnector interface {
 // Directly connects client
 type DcDirectConnector struct {
 	allowIPv6 bool
+	timeout   time.Duration
 }
 
 var _ DCConnector = &DcDirectConnector{}
 
-// creates a new DcDirectConnector
-func NewDcDirectConnector(allowIPv6 bool) *DcDirectConnector {
+// creates a new DcDirectConnector. Zero timeout means no timeout.
+func NewDcDirectConnector(allowIPv6 bool, timeout time.Duration) *DcDirectConnector {
 	return &DcDirectConnector{
 		allowIPv6: allowIPv6,
+		timeout:   timeout,
 	}
 }
 
@@ -40,7 +45,7 @@ func (dcc *DcDirectConnector) ConnectDC(dc int16) (stream io.ReadWriteCloser, er
 	if !dcc.allowIPv6 {
 		dcAddr6 = ""
 	}
-	c, err4, err6 := dialBoth(dcAddr4, dcAddr6, proxy.Direct)
+	c, err4, err6 := dialBoth(dcAddr4, dcAddr6, proxy.Direct, dcc.timeout)
 	if err4 != nil && err6 != nil {
 		return nil, fmt.Errorf("can't connect to dc %w, %w", err4, err6)
 	}
@@ -49,7 +54,7 @@ func (dcc *DcDirectConnector) ConnectDC(dc int16) (stream io.ReadWriteCloser, er
 }
 
 func (dcc *DcDirectConnector) ConnectHost(host string) (net.Conn, error) {
-	c, err := net.Dial("tcp", host)
+	c, err := dialTimeout(proxy.Direct, host, dcc.timeout)
 	if err != nil {
 		return nil, err
 	}
@@ -63,17 +68,20 @@ type DcSocksConnector struct {
 	user      *string
 	pass      *string
 	socks5    string
+	timeout   time.Duration
 }
 
 var _ DCConnector = &DcSocksConnector{}
 
-// Create a new DcSocksConnector
-func NewDcSocksConnector(allowIPv6 bool, socks5 string, user, pass *string) *DcSocksConnector {
+// Create a new DcSocksConnector. Timeout covers both connection to proxy and
+// socks handshake, zero means no timeout.
+func NewDcSocksConnector(allowIPv6 bool, socks5 string, user, pass *string, timeout time.Duration) *DcSocksConnector {
 	return &DcSocksConnector{
 		allowIPv6: allowIPv6,
 		user:      user,
 		pass:      pass,
 		socks5:    socks5,
+		timeout:   timeout,
 	}
 }
 
@@ -112,7 +120,7 @@ func (dsc *DcSocksConnector) ConnectDC(dc int16) (io.ReadWriteCloser, error) {
 	if !dsc.allowIPv6 {
 		dcAddr6 = ""
 	}
-	c, err4, err6 := dialBoth(dcAddr4, dcAddr6, dialer)
+	c, err4, err6 := dialBoth(dcAddr4, dcAddr6, dialer, dsc.timeout)
 	if err4 != nil && err6 != nil {
 		return nil, fmt.Errorf("can't connect to dc: %w, %w", err4, err6)
 	}
@@ -125,7 +133,7 @@ func (dsc *DcSocksConnector) ConnectHost(host string) (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	c, err := dialer.Dial("tcp", host)
+	c, err := dialTimeout(dialer, host, dsc.timeout)
 	if err != nil {
 		return nil, fmt.Errorf("can't connect to host %w", err)
 	}
@@ -133,17 +141,34 @@ func (dsc *DcSocksConnector) ConnectHost(host string) (net.Conn, error) {
 	return c, nil
 }
 
+// dial with timeout if dialer supports context. Zero timeout means no timeout.
+func dialTimeout(dialer proxy.Dialer, addr string, timeout time.Duration) (net.Conn, error) {
+	cd, ok := dialer.(proxy.ContextDialer)
+	if timeout <= 0 || !ok {
+		return dialer.Dial("tcp", addr)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return cd.DialContext(ctx, "tcp", addr)
+}
+
+// check if error is caused by timeout
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout())
+}
+
 // Try to dial both ipv4 and ipv6 addresses and return resulting connection
-func dialBoth(host4, host6 string, dialer proxy.Dialer) (c net.Conn, err4, err6 error) {
+func dialBoth(host4, host6 string, dialer proxy.Dialer, timeout time.Duration) (c net.Conn, err4, err6 error) {
 	if host6 != "" {
-		c, err6 = dialer.Dial("tcp", host6)
+		c, err6 = dialTimeout(dialer, host6, timeout)
 		if err6 == nil {
 			return
 		}
 	} else {
 		err6 = fmt.Errorf("no ipv6 address specified")
 	}
-	c, err4 = dialer.Dial("tcp", host4)
+	c, err4 = dialTimeout(dialer, host4, timeout)
 	if err4 != nil {
 		return nil, err4, err6
 	}
@@ -151,11 +176,11 @@ func dialBoth(host4, host6 string, dialer proxy.Dialer) (c net.Conn, err4, err6
 }
 
 // if socks5 info is specified, return socks5 DcSocksConnector else return direct DcDirectConnector
-func dcConnectorFromSocks(url, user, pass *string, allowIPv6 bool) (conn DCConnector, err error) {
+func dcConnectorFromSocks(url, user, pass *string, allowIPv6 bool, timeout time.Duration) (conn DCConnector, err error) {
 	if url == nil || *url == "" {
-		return NewDcDirectConnector(allowIPv6), nil
+		return NewDcDirectConnector(allowIPv6, timeout), nil
 	} else {
-		return NewDcSocksConnector(allowIPv6, *url, user, pass), nil
+		return NewDcSocksConnector(allowIPv6, *url, user, pass, timeout), nil
 	}
 }
 
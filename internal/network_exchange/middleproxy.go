@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"sync"
@@ -41,6 +42,43 @@ func getMiddleProxyManager(cfg *config.Config) (*MiddleProxyManager, error) {
 	return mpm, nil
 }
 
+// Result of middle proxy list refreshes
+type MiddleProxyStatus struct {
+	// false until first refresh attempt (middle proxy was never needed)
+	Attempted   bool
+	LastAttempt time.Time
+	LastSuccess time.Time
+	// last attempt succeeded
+	Ok       bool
+	Failures uint64
+}
+
+var (
+	mpStatusLock sync.Mutex
+	mpStatus     MiddleProxyStatus
+)
+
+// status of middle proxy list refreshes
+func GetMiddleProxyStatus() MiddleProxyStatus {
+	mpStatusLock.Lock()
+	defer mpStatusLock.Unlock()
+	return mpStatus
+}
+
+func recordProxyListUpdate(err error) {
+	mpStatusLock.Lock()
+	defer mpStatusLock.Unlock()
+	now := time.Now()
+	mpStatus.Attempted = true
+	mpStatus.LastAttempt = now
+	mpStatus.Ok = err == nil
+	if err == nil {
+		mpStatus.LastSuccess = now
+	} else {
+		mpStatus.Failures++
+	}
+}
+
 type MiddleProxyManager struct {
 	cfg      *config.Config
 	mutex    sync.Mutex
@@ -54,6 +92,7 @@ func NewMiddleProxyManager(cfg *config.Config) (*MiddleProxyManager, error) {
 		cfg: cfg,
 	}
 	err := m.updateProxyList()
+	recordProxyListUpdate(err)
 	if err != nil {
 		return nil, fmt.Errorf("failed to update proxy list: %w", err)
 	}
@@ -138,8 +177,9 @@ func (m *MiddleProxyManager) proxyListUpdateRoutine() {
 		_, ok := <-updateTimer.C
 		if ok {
 			err := m.updateProxyList()
+			recordProxyListUpdate(err)
 			if err != nil {
-				fmt.Printf("failed to update middleproxy list: %v\n", err)
+				slog.Error("failed to update middleproxy list", "error", err)
 			}
 		} else {
 			return
@@ -193,7 +233,7 @@ func (m *MiddleProxyManager) connectRetry(dc int16, client net.Conn, cliProtocol
 	defer reconnectTimer.Stop()
 	for {
 		<-reconnectTimer.C
-		mp, err := m.connect(dc, client, cliProtocol, addTag)
+		mp, err := m.connect(dc, client, cliProtocol, addTag, connectTimeout)
 		if err != nil {
 			continue
 		}
@@ -205,8 +245,8 @@ func (m *MiddleProxyManager) connectRetry(dc int16, client net.Conn, cliProtocol
 	}
 }
 
-func (m *MiddleProxyManager) connect(dc int16, client net.Conn, clientProtocol uint8, addTag []byte) (*MiddleProxyStream, error) {
-	//fmt.Printf("middle connect dc: %d\n", dc)
+// connect and login to middle proxy. Zero timeout means no timeout.
+func (m *MiddleProxyManager) connect(dc int16, client net.Conn, clientProtocol uint8, addTag []byte, timeout time.Duration) (*MiddleProxyStream, error) {
 	url4, url6, err := m.GetProxy(dc)
 	if err != nil {
 		return nil, err
@@ -214,10 +254,10 @@ func (m *MiddleProxyManager) connect(dc int16, client net.Conn, clientProtocol u
 	if !m.cfg.GetAllowIPv6() {
 		url6 = ""
 	}
-	fmt.Printf("connecting to %d, %s %s\n", dc, url4, url6)
-	this2middle, err := connect64(url4, url6)
+	slog.Debug("connecting to middle proxy", "dc", dc, "url4", url4, "url6", url6)
+	this2middle, err := connect64(url4, url6, timeout)
 	if err != nil {
-		fmt.Printf("middleproxy connection failed\n")
+		slog.Warn("middle proxy connection failed", "dc", dc, "error", err)
 		return nil, err
 	}
 	this2middleTcp, ok := this2middle.(*net.TCPConn)
@@ -230,6 +270,17 @@ func (m *MiddleProxyManager) connect(dc int16, client net.Conn, clientProtocol u
 	if mps == nil {
 		panic(fmt.Errorf("failed to create middle proxy stream"))
 	}
+	if timeout > 0 {
+		this2middle.SetDeadline(time.Now().Add(timeout))
+	}
+	loginStart := time.Now()
+	err = mps.Initiate()
+	if err != nil {
+		this2middle.Close()
+		return nil, fmt.Errorf("can't login to middle proxy: %w", err)
+	}
+	mps.loginTime = time.Since(loginStart)
+	this2middle.SetDeadline(time.Time{})
 	return mps, nil
 }
 
@@ -237,15 +288,15 @@ func (m *MiddleProxyManager) connect(dc int16, client net.Conn, clientProtocol u
 // only direct connections supported by Telegram middle-proxies (encryption is
 // based on IPs)
 // TODO: wrap error into struct
-func connect64(url4, url6 string) (c net.Conn, err error) {
+func connect64(url4, url6 string, timeout time.Duration) (c net.Conn, err error) {
 	var err6, err4 error
 	if url6 != "" {
-		c, err6 = net.DialTimeout("tcp", url6, connectTimeout)
+		c, err6 = net.DialTimeout("tcp", url6, timeout)
 		if err6 == nil {
 			return c, nil
 		}
 	}
-	c, err4 = net.DialTimeout("tcp", url4, connectTimeout)
+	c, err4 = net.DialTimeout("tcp", url4, timeout)
 	if err4 == nil {
 		return c, nil
 	}
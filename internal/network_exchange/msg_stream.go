@@ -1,6 +1,10 @@
 package network_exchange
 
-import "sync"
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
 
 type message struct {
 	data     []byte // if nil, skip send
@@ -25,6 +29,20 @@ type msgStreamCli interface {
 	WriteCliMsg(m *message) error
 }
 
+// protocol dumps are expensive, so they are prepared only if needed
+func debugEnabled() bool {
+	return slog.Default().Enabled(context.Background(), slog.LevelDebug)
+}
+
+// adapts message stream to io.Closer
+type streamCloser struct {
+	s MsgStreanCloser
+}
+
+func (c streamCloser) Close() error {
+	return c.s.CloseStream()
+}
+
 type msgStream struct {
 	sock dataStream
 }
@@ -45,21 +63,28 @@ func (s *msgStream) Initiate() error {
 }
 
 //lint:ignore U1000 will be used later
-func transceiveMsgStreams(client, dc dataStream) (errc, errd error) {
+func transceiveMsgStreams(client, dc dataStream, opts relayOptions) (errc, errd error) {
 	defer client.Close()
 	defer dc.Close()
 	clientStream := newMsgStream(client)
 	dcStream := newMsgStream(dc)
-	return transceiveMsg(clientStream, dcStream)
+	return transceiveMsg(clientStream, dcStream, opts)
 }
 
-func transceiveMsg(client msgStreamCli, dc msgStreamSrv) (err1, err2 error) {
+// relay messages between streams. Same as transceiveStreams for messages.
+func transceiveMsg(client msgStreamCli, dc msgStreamSrv, opts relayOptions) (err1, err2 error) {
 	defer client.CloseStream()
 	defer dc.CloseStream()
 	err2 = dc.Initiate()
 	if err2 != nil {
 		return
 	}
+	watcher := newIdleWatcher(opts.idle, streamCloser{client}, streamCloser{dc})
+	defer func() {
+		if err := watcher.stop(); err != nil {
+			err1 = err
+		}
+	}()
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
@@ -72,8 +97,9 @@ func transceiveMsg(client msgStreamCli, dc msgStreamSrv) (err1, err2 error) {
 			if err1 != nil {
 				return
 			}
+			watcher.touch()
 			if msg.data != nil {
-				//fmt.Printf("client msg: %d bytes \n", len(msg.data))
+				opts.passUp(len(msg.data), 1)
 				err1 = dc.WriteSrvMsg(msg)
 				if err1 != nil {
 					return
@@ -91,8 +117,9 @@ func transceiveMsg(client msgStreamCli, dc msgStreamSrv) (err1, err2 error) {
 			if err2 != nil {
 				return
 			}
+			watcher.touch()
 			if msg.data != nil {
-				//fmt.Printf("srv msg: %d bytes \n", len(msg.data))
+				opts.passDown(len(msg.data), 1)
 				err2 = client.WriteCliMsg(msg)
 				if err2 != nil {
 					return
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
+	"log/slog"
 
 	"github.com/geovex/tgp/internal/tgcrypt_encryption"
 )
@@ -24,7 +25,7 @@ func (s *msgStream) ReadCliMsg() (m *message, err error) {
 		}
 		if l[0]&0x80 != 0 {
 			quickack = false
-			fmt.Printf("client read quickack abridged %x\n", l)
+			slog.Debug("client read quickack abridged", "length", l[:1])
 			l[0] &= 0x7f
 		}
 		if l[0] < 0x7f {
@@ -111,7 +112,7 @@ func (s *msgStream) ReadCliMsg() (m *message, err error) {
 		return nil, fmt.Errorf("unsupported protocol: %x", s.sock.Protocol())
 	}
 	if quickack {
-		fmt.Printf("client read quickack\n")
+		slog.Debug("client read quickack")
 	}
 	m = &message{data: msgbuf, quickack: quickack, seq: seq}
 	return
@@ -122,10 +123,10 @@ func (s *msgStream) WriteCliMsg(m *message) (err error) {
 	if m.quickack {
 		if s.sock.Protocol() == tgcrypt_encryption.Abridged {
 			sendmsg = []byte{m.data[3], m.data[2], m.data[1], m.data[0]}
-			fmt.Printf("client write quickack abridged %v\n", sendmsg[:4])
+			slog.Debug("client write quickack abridged", "ack", sendmsg[:4])
 		} else {
 			sendmsg = m.data
-			fmt.Printf("client write quickack %v\n", sendmsg)
+			slog.Debug("client write quickack", "ack", sendmsg)
 		}
 		_, err = s.sock.Write(sendmsg)
 		if err != nil {
@@ -158,7 +159,6 @@ func (s *msgStream) WriteCliMsg(m *message) (err error) {
 		crc := crc32.ChecksumIEEE(sendmsg)
 		sendmsg = binary.LittleEndian.AppendUint32(sendmsg, crc)
 	default:
-		fmt.Printf("Cli unsupported protocol: %x\n", s.sock.Protocol())
 		return fmt.Errorf("unsupported protocol: %x", s.sock.Protocol())
 	}
 	_, err = s.sock.Write(sendmsg)
@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/netip"
 	"sync/atomic"
@@ -28,6 +29,8 @@ type MiddleProxyStream struct {
 	middleProxySock      dataStream
 	middleProxyMsgStream *msgBlockStream
 	connId               [8]byte
+	// time spent on login, set by manager on connect
+	loginTime time.Duration
 }
 
 func NewMiddleProxyStream(mpStream dataStream, client, mp net.Conn, addTag []byte, clientProtocol uint8) *MiddleProxyStream {
@@ -45,16 +48,17 @@ func NewMiddleProxyStream(mpStream dataStream, client, mp net.Conn, addTag []byt
 	ctx := tgcrypt_encryption.NewMiddleCtx(this2mpLocalTcpAddr.AddrPort(), middleProxyTcpAddr.AddrPort(), addTag)
 	seq := uint32(0)
 	seq -= 2
-	cli2thisAddr := client.RemoteAddr()
-	cli2thisTcpAddr, ok := cli2thisAddr.(*net.TCPAddr)
-	if !ok {
-		panic("clientent connection has no local address")
+	// clients from unix socket listeners have no ip address
+	clientAddr := netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+	cli2thisTcpAddr, ok := client.RemoteAddr().(*net.TCPAddr)
+	if ok {
+		clientAddr = cli2thisTcpAddr.AddrPort()
 	}
 	return &MiddleProxyStream{
 		initiated:       false,
 		closed:          atomic.Bool{},
 		thisProtocol:    clientProtocol,
-		clientAddr:      cli2thisTcpAddr.AddrPort(),
+		clientAddr:      clientAddr,
 		seq:             seq,
 		encryptionCtx:   ctx,
 		middleProxySock: mpStream,
@@ -74,7 +78,7 @@ func (s *MiddleProxyStream) Initiate() (err error) {
 // login into middle proxy
 func (m *MiddleProxyStream) initiateReally() (err error) {
 	m.initiated = true
-	fmt.Println("initiating")
+	slog.Debug("middle proxy login")
 	initialMsgData := make([]byte, 0, 32)
 	initialMsgData = append(initialMsgData, tgcrypt_encryption.RpcNonceTag[:]...)
 	secret := mpm.GetSecret()
@@ -98,7 +102,6 @@ func (m *MiddleProxyStream) initiateReally() (err error) {
 	m.seq++
 	msg, err = middleProxyMsgStream.ReadMsg()
 	if err != nil {
-		fmt.Printf("failed to read initial reply: %v\n", err)
 		return fmt.Errorf("failed to read initial reply: %w", err)
 	}
 	if len(msg.data) != 32 {
@@ -122,7 +125,6 @@ func (m *MiddleProxyStream) initiateReally() (err error) {
 	handshakeMsg = append(handshakeMsg, 0, 0, 0, 0)                //rpc flags
 	handshakeMsg = append(handshakeMsg, []byte("IPIPPRPDTIME")...) //SENDER_PID
 	handshakeMsg = append(handshakeMsg, []byte("IPIPPRPDTIME")...) //PEER_PID
-	//fmt.Println(hex.EncodeToString(handshakeMsg))
 	msg = &message{
 		data:     handshakeMsg,
 		quickack: false,
@@ -135,7 +137,6 @@ func (m *MiddleProxyStream) initiateReally() (err error) {
 	m.seq++
 	msg, err = m.middleProxyMsgStream.ReadMsg()
 	if err != nil {
-		fmt.Printf("failed to read encrypted handshake reply: %v\n", err)
 		return fmt.Errorf("failed to read encrypted reply: %w", err)
 	}
 	if len(msg.data) != 32 {
@@ -155,7 +156,7 @@ func (m *MiddleProxyStream) ReadSrvMsg() (*message, error) {
 	if err != nil {
 		// filter closed stream false positives
 		if !m.closed.Load() {
-			fmt.Printf("failed to read middleproxy message: %v\n", err)
+			slog.Debug("failed to read middleproxy message", "error", err)
 		}
 		return nil, fmt.Errorf("failed to read message: %w", err)
 	}
@@ -178,7 +179,7 @@ func (m *MiddleProxyStream) ReadSrvMsg() (*message, error) {
 		}
 		return &newmsg, nil
 	} else if tgcrypt_encryption.RpcCloseExtTag == rpcTag {
-		fmt.Printf("End of middleproxy stream")
+		slog.Debug("end of middleproxy stream")
 		return nil, fmt.Errorf("end of middleproxy stream")
 	} else if tgcrypt_encryption.RpcUnknown == rpcTag {
 		newmsg := message{
@@ -186,7 +187,7 @@ func (m *MiddleProxyStream) ReadSrvMsg() (*message, error) {
 		}
 		return &newmsg, nil
 	} else {
-		fmt.Printf("Middleproxy message not parsed\n")
+		slog.Debug("middleproxy message not parsed", "tag", rpcTag[:])
 		return nil, fmt.Errorf("middleproxy message not parsed")
 	}
 }
@@ -247,7 +248,6 @@ func (m *MiddleProxyStream) WriteSrvMsg(msg *message) error {
 	}
 	err := m.middleProxyMsgStream.WriteMsg(&wrappedMsg)
 	if err != nil {
-		fmt.Printf("failed to send message: %v\n", err)
 		return fmt.Errorf("failed to send message: %w", err)
 	}
 	m.seq++
@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"log/slog"
 
 	"github.com/geovex/tgp/internal/tgcrypt_encryption"
 )
@@ -32,7 +33,7 @@ func (s *msgStream) ReadSrvMsg() (m *message, err error) {
 			}
 			if l[0]&0x80 != 0 {
 				m = &message{[]byte{l[3], l[2], l[1], l[0]}, true, 0}
-				fmt.Printf("server read quickack abridged %v\n", m.data)
+				slog.Debug("server read quickack abridged", "ack", m.data)
 				return
 			}
 			msgLen = binary.LittleEndian.Uint32(l[:]) >> 8
@@ -61,7 +62,7 @@ func (s *msgStream) ReadSrvMsg() (m *message, err error) {
 		}
 		msgLen := binary.LittleEndian.Uint32(l[:])
 		if msgLen&0x80000000 != 0 {
-			fmt.Printf("server read quickack %d\n", msgLen)
+			slog.Debug("server read quickack", "length", msgLen)
 			m = &message{l[:], true, 0}
 			return
 		}
@@ -102,20 +103,21 @@ func (s *msgStream) WriteSrvMsg(m *message) (err error) {
 		if m.quickack {
 			sendmsg[0] |= 0x80
 			sendmsg = []byte{sendmsg[3], sendmsg[2], sendmsg[1], sendmsg[0]}
-			fmt.Printf("server write quickack abridged %v\n", sendmsg)
+			slog.Debug("server write quickack abridged", "ack", sendmsg)
 		}
 	case tgcrypt_encryption.Intermediate, tgcrypt_encryption.Padded:
 		sendmsg = binary.LittleEndian.AppendUint32(sendmsg, uint32(len(m.data)))
 		sendmsg = append(sendmsg, m.data...)
 		if m.quickack {
 			sendmsg[3] |= 0x80
-			fmt.Printf("server write quickack %d\n", sendmsg[3])
+			slog.Debug("server write quickack", "ack", sendmsg[3])
 		}
 	default:
-		fmt.Printf("Srv unsupported protocol: %x\n", s.sock.Protocol())
 		return fmt.Errorf("unsupported protocol: %x", s.sock.Protocol())
 	}
-	fmt.Printf("msg write seq: %d hex: %s\n", m.seq, hex.EncodeToString(sendmsg))
+	if debugEnabled() {
+		slog.Debug("server write message", "seq", m.seq, "hex", hex.EncodeToString(sendmsg))
+	}
 	_, err = s.sock.Write(sendmsg)
 	if err != nil {
 		err = fmt.Errorf("failed to send message: %w", err)
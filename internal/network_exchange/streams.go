@@ -1,8 +1,15 @@
 package network_exchange
 
 import (
+	"encoding/binary"
+	"errors"
 	"io"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/geovex/tgp/internal/rate_limit"
+	"github.com/geovex/tgp/internal/tgcrypt_encryption"
 )
 
 // Describes common logic for byte streams (usually to DC)
@@ -17,17 +24,181 @@ type dataStream interface {
 	Protocol() uint8
 }
 
-func transceiveDataStreams(client, dc dataStream) (errc, errd error) {
+var errIdleTimeout = errors.New("idle timeout")
+
+// Closes streams if there was no activity during timeout
+type idleWatcher struct {
+	timeout time.Duration
+	timer   *time.Timer
+	expired atomic.Bool
+}
+
+// start watching. Zero timeout disables watcher.
+func newIdleWatcher(timeout time.Duration, closers ...io.Closer) *idleWatcher {
+	w := &idleWatcher{timeout: timeout}
+	if timeout > 0 {
+		w.timer = time.AfterFunc(timeout, func() {
+			w.expired.Store(true)
+			for _, c := range closers {
+				c.Close()
+			}
+		})
+	}
+	return w
+}
+
+// register activity
+func (w *idleWatcher) touch() {
+	if w.timer != nil && !w.expired.Load() {
+		w.timer.Reset(w.timeout)
+	}
+}
+
+// stop watching, returns errIdleTimeout if streams were closed by watcher
+func (w *idleWatcher) stop() error {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	if w.expired.Load() {
+		return errIdleTimeout
+	}
+	return nil
+}
+
+// Receives amount of relayed traffic
+type trafficCounter interface {
+	// client to dc bytes and messages
+	CountUp(bytes, msgs int)
+	// dc to client bytes and messages
+	CountDown(bytes, msgs int)
+}
+
+// Session parameters for relay loops
+type relayOptions struct {
+	// close streams if both sides are silent for this time, 0 disables
+	idle time.Duration
+	// may be nil
+	traffic trafficCounter
+	// rate limiters applied to client to dc and dc to client traffic
+	limitUp, limitDown []*rate_limit.Limiter
+	// message counters of relayed byte streams, nil if framing is unknown
+	framesUp, framesDown *frameCounter
+}
+
+// Counts messages of tg protocol in relayed byte stream. Data may be split
+// between reads at any point.
+type frameCounter struct {
+	protocol uint8
+	// dc to client direction, quick acks are sent there without payload
+	down bool
+	// collected bytes of message length
+	header []byte
+	// payload bytes left of current message
+	skip int
+}
+
+// counter for protocol, nil for protocols without known framing
+func newFrameCounter(protocol uint8, down bool) *frameCounter {
+	switch protocol {
+	case tgcrypt_encryption.Abridged, tgcrypt_encryption.Intermediate, tgcrypt_encryption.Padded:
+		return &frameCounter{protocol: protocol, down: down, header: make([]byte, 0, 4)}
+	default:
+		return nil
+	}
+}
+
+// number of messages starting in data
+func (f *frameCounter) count(data []byte) (messages int) {
+	if f == nil {
+		return 0
+	}
+	for len(data) > 0 {
+		if f.skip > 0 {
+			n := min(f.skip, len(data))
+			f.skip -= n
+			data = data[n:]
+			continue
+		}
+		f.header = append(f.header, data[0])
+		data = data[1:]
+		if f.headerDone() {
+			messages++
+			f.header = f.header[:0]
+		}
+	}
+	return messages
+}
+
+// check if message length is complete and set payload size
+func (f *frameCounter) headerDone() bool {
+	if f.protocol == tgcrypt_encryption.Abridged {
+		first := f.header[0]
+		switch {
+		case f.down && first&0x80 != 0:
+			// quick ack
+			return len(f.header) == 4
+		case first&0x7f < 0x7f:
+			f.skip = int(first&0x7f) * 4
+			return true
+		case len(f.header) == 4:
+			f.skip = int(uint32(f.header[1])|uint32(f.header[2])<<8|uint32(f.header[3])<<16) * 4
+			return true
+		}
+		return false
+	}
+	if len(f.header) < 4 {
+		return false
+	}
+	l := binary.LittleEndian.Uint32(f.header)
+	if f.down && l&0x80000000 != 0 {
+		// quick ack
+		return true
+	}
+	f.skip = int(l & 0x7fffffff)
+	return true
+}
+
+// count data passed from client to dc and wait if it's over rate limits
+func (o *relayOptions) passUp(bytes, msgs int) {
+	if o.traffic != nil {
+		o.traffic.CountUp(bytes, msgs)
+	}
+	for _, l := range o.limitUp {
+		l.Wait(bytes)
+	}
+}
+
+// count data passed from dc to client and wait if it's over rate limits
+func (o *relayOptions) passDown(bytes, msgs int) {
+	if o.traffic != nil {
+		o.traffic.CountDown(bytes, msgs)
+	}
+	for _, l := range o.limitDown {
+		l.Wait(bytes)
+	}
+}
+
+func transceiveDataStreams(client, dc dataStream, opts relayOptions) (errc, errd error) {
 	errd = dc.Initiate()
 	if errd != nil {
 		return
 	}
-	return transceiveStreams(client, dc)
+	opts.framesUp = newFrameCounter(client.Protocol(), false)
+	opts.framesDown = newFrameCounter(client.Protocol(), true)
+	return transceiveStreams(client, dc, opts)
 }
 
-func transceiveStreams(client, dc io.ReadWriteCloser) (err1, err2 error) {
+// relay data between streams until one of them is closed or both are silent
+// for idle time. errIdleTimeout is returned as err1 in last case.
+func transceiveStreams(client, dc io.ReadWriteCloser, opts relayOptions) (err1, err2 error) {
 	defer client.Close()
 	defer dc.Close()
+	watcher := newIdleWatcher(opts.idle, client, dc)
+	defer func() {
+		if err := watcher.stop(); err != nil {
+			err1 = err
+		}
+	}()
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
@@ -41,6 +212,8 @@ func transceiveStreams(client, dc io.ReadWriteCloser) (err1, err2 error) {
 			if err1 != nil {
 				return
 			}
+			watcher.touch()
+			opts.passUp(size, opts.framesUp.count(buf[:size]))
 			_, err1 = dc.Write(buf[:size])
 			if err1 != nil {
 				return
@@ -58,6 +231,8 @@ func transceiveStreams(client, dc io.ReadWriteCloser) (err1, err2 error) {
 			if err2 != nil {
 				return
 			}
+			watcher.touch()
+			opts.passDown(size, opts.framesDown.count(buf[:size]))
 			_, err2 = client.Write(buf[:size])
 			if err2 != nil {
 				return
@@ -67,3 +242,22 @@ func transceiveStreams(client, dc io.ReadWriteCloser) (err1, err2 error) {
 	wg.Wait()
 	return
 }
+
+type limiterKey struct {
+	user   string
+	global bool
+	up     bool
+}
+
+// rate limiters shared by all sessions of user and global ones
+var limiters = rate_limit.NewRegistry[limiterKey]()
+
+// add rate limiters, nil limiters (unlimited) are skipped
+func (o *relayOptions) addLimits(up, down *rate_limit.Limiter) {
+	if up != nil {
+		o.limitUp = append(o.limitUp, up)
+	}
+	if down != nil {
+		o.limitDown = append(o.limitDown, down)
+	}
+}
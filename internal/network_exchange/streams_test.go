@@ -0,0 +1,44 @@
+package network_exchange
+
+import (
+	"testing"
+
+	"github.com/geovex/tgp/internal/tgcrypt_encryption"
+)
+
+func TestFrameCounter(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol uint8
+		down     bool
+		data     []byte
+		messages int
+	}{
+		{"abridged", tgcrypt_encryption.Abridged, false,
+			append([]byte{2, 1, 2, 3, 4, 5, 6, 7, 8, 0x7f, 1, 0, 0, 1, 2, 3, 4}, 1, 9, 9, 9, 9), 3},
+		{"abridged quickack", tgcrypt_encryption.Abridged, true,
+			[]byte{0x80, 1, 2, 3, 1, 1, 2, 3, 4}, 2},
+		{"intermediate", tgcrypt_encryption.Intermediate, false,
+			[]byte{2, 0, 0, 0, 1, 2, 0, 0, 0, 0, 1, 0, 0, 0, 7}, 3},
+		{"intermediate quickack", tgcrypt_encryption.Padded, true,
+			[]byte{1, 2, 3, 0x80, 1, 0, 0, 0, 9}, 2},
+	}
+	for _, tt := range tests {
+		// count at once and split into single bytes
+		f := newFrameCounter(tt.protocol, tt.down)
+		if got := f.count(tt.data); got != tt.messages {
+			t.Errorf("%s: counted %d messages, want %d", tt.name, got, tt.messages)
+		}
+		f = newFrameCounter(tt.protocol, tt.down)
+		got := 0
+		for i := range tt.data {
+			got += f.count(tt.data[i : i+1])
+		}
+		if got != tt.messages {
+			t.Errorf("%s: counted %d messages byte by byte, want %d", tt.name, got, tt.messages)
+		}
+	}
+	if f := newFrameCounter(tgcrypt_encryption.Full, false); f.count([]byte{1, 2, 3}) != 0 {
+		t.Errorf("unknown framing counted messages")
+	}
+}
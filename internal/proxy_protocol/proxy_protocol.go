@@ -0,0 +1,164 @@
+// PROXY protocol (v1 and v2) support for connections coming through load
+// balancers. See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+package proxy_protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte{0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a}
+)
+
+const (
+	v1MaxLen = 107
+	v2MaxLen = 16 + 65535
+)
+
+const (
+	v2CmdLocal = 0x0
+	v2CmdProxy = 0x1
+	v2FamTcp4  = 0x11
+	v2FamTcp6  = 0x21
+)
+
+var ErrNoHeader = errors.New("no proxy protocol header")
+
+// Connection with client address taken from PROXY protocol header
+type Conn struct {
+	net.Conn
+	remote net.Addr
+}
+
+var _ net.Conn = &Conn{}
+
+// real client address (or address of balancer if header does not carry it)
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Read PROXY protocol v1 or v2 header from connection. Connection without
+// valid header is rejected. No data after header is consumed.
+func ReadHeader(conn net.Conn) (*Conn, error) {
+	var start [12]byte
+	_, err := io.ReadFull(conn, start[:])
+	if err != nil {
+		return nil, fmt.Errorf("can't read proxy protocol header: %w", err)
+	}
+	var remote net.Addr
+	switch {
+	case bytes.HasPrefix(start[:], v1Prefix):
+		remote, err = readV1(conn, start[:])
+	case bytes.Equal(start[:], v2Signature):
+		remote, err = readV2(conn)
+	default:
+		return nil, ErrNoHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &Conn{Conn: conn, remote: remote}, nil
+}
+
+// parse text header. start contains already read bytes
+func readV1(r io.Reader, start []byte) (net.Addr, error) {
+	line := append([]byte{}, start...)
+	var b [1]byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= v1MaxLen {
+			return nil, fmt.Errorf("proxy protocol v1 header too long")
+		}
+		_, err := io.ReadFull(r, b[:])
+		if err != nil {
+			return nil, fmt.Errorf("can't read proxy protocol v1 header: %w", err)
+		}
+		line = append(line, b[0])
+	}
+	return parseV1(string(line[:len(line)-2]))
+}
+
+func parseV1(line string) (net.Addr, error) {
+	fields := strings.Split(line, " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("invalid proxy protocol v1 header")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unknown proxy protocol v1 family %s", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("invalid proxy protocol v1 header")
+	}
+	src, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy protocol v1 source address: %w", err)
+	}
+	if src.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("proxy protocol v1 address does not match family %s", fields[1])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy protocol v1 source port: %w", err)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, uint16(port))), nil
+}
+
+// parse binary header after signature
+func readV2(r io.Reader) (net.Addr, error) {
+	var hdr [4]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return nil, fmt.Errorf("can't read proxy protocol v2 header: %w", err)
+	}
+	if hdr[0]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported proxy protocol version %d", hdr[0]>>4)
+	}
+	length := binary.BigEndian.Uint16(hdr[2:4])
+	data := make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, fmt.Errorf("can't read proxy protocol v2 addresses: %w", err)
+	}
+	switch hdr[0] & 0x0f {
+	case v2CmdLocal:
+		// health check from balancer itself
+		return nil, nil
+	case v2CmdProxy:
+	default:
+		return nil, fmt.Errorf("unknown proxy protocol v2 command %d", hdr[0]&0x0f)
+	}
+	switch hdr[1] {
+	case v2FamTcp4:
+		if len(data) < 12 {
+			return nil, fmt.Errorf("proxy protocol v2 ipv4 addresses too short")
+		}
+		src := netip.AddrFrom4([4]byte(data[0:4]))
+		port := binary.BigEndian.Uint16(data[8:10])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, port)), nil
+	case v2FamTcp6:
+		if len(data) < 36 {
+			return nil, fmt.Errorf("proxy protocol v2 ipv6 addresses too short")
+		}
+		src := netip.AddrFrom16([16]byte(data[0:16]))
+		port := binary.BigEndian.Uint16(data[32:34])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, port)), nil
+	default:
+		// unspecified or non tcp family, keep balancer address
+		return nil, nil
+	}
+}
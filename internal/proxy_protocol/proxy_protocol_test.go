@@ -0,0 +1,84 @@
+package proxy_protocol
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// write header and payload into one end of pipe, read header on other
+func readFromPipe(t *testing.T, data []byte) (*Conn, error) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		client.Write(data)
+		client.Write([]byte("payload"))
+		client.Close()
+	}()
+	conn, err := ReadHeader(server)
+	if err != nil {
+		return nil, err
+	}
+	rest, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "payload" {
+		t.Errorf("payload corrupted: %q", rest)
+	}
+	return conn, nil
+}
+
+func TestV1Tcp4(t *testing.T) {
+	conn, err := readFromPipe(t, []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.RemoteAddr().String() != "192.168.0.1:56324" {
+		t.Errorf("wrong remote address %s", conn.RemoteAddr())
+	}
+}
+
+func TestV1Tcp6(t *testing.T) {
+	conn, err := readFromPipe(t, []byte("PROXY TCP6 2001:db8::1 2001:db8::2 4000 443\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.RemoteAddr().String() != "[2001:db8::1]:4000" {
+		t.Errorf("wrong remote address %s", conn.RemoteAddr())
+	}
+}
+
+func TestV1Unknown(t *testing.T) {
+	conn, err := readFromPipe(t, []byte("PROXY UNKNOWN\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.RemoteAddr() == nil {
+		t.Errorf("no fallback remote address")
+	}
+}
+
+func TestV2Tcp4(t *testing.T) {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, 0x21, v2FamTcp4)
+	header = binary.BigEndian.AppendUint16(header, 12)
+	header = append(header, 10, 0, 0, 1, 10, 0, 0, 2)
+	header = binary.BigEndian.AppendUint16(header, 1234)
+	header = binary.BigEndian.AppendUint16(header, 443)
+	conn, err := readFromPipe(t, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.RemoteAddr().String() != "10.0.0.1:1234" {
+		t.Errorf("wrong remote address %s", conn.RemoteAddr())
+	}
+}
+
+func TestNoHeader(t *testing.T) {
+	_, err := readFromPipe(t, []byte("GET / HTTP/1.1\r\n\r\n"))
+	if err != ErrNoHeader {
+		t.Errorf("expected ErrNoHeader, got %v", err)
+	}
+}
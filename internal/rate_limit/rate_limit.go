@@ -0,0 +1,109 @@
+// Token bucket limiters for relayed traffic
+package rate_limit
+
+import (
+	"sync"
+	"time"
+)
+
+// minimal bucket size, allows typical reads to pass without waiting
+const minBurst = 64 << 10
+
+// Token bucket with rate in bytes per second. Bucket holds one second of
+// traffic. Waiters may take more tokens than available, following waiters
+// are delayed until the debt is paid.
+type Limiter struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	sleep  func(time.Duration)
+}
+
+func New(rate int64) *Limiter {
+	l := &Limiter{
+		now:   time.Now,
+		sleep: time.Sleep,
+	}
+	l.last = l.now()
+	l.setRate(rate)
+	l.tokens = l.burst
+	return l
+}
+
+func (l *Limiter) setRate(rate int64) {
+	l.rate = float64(rate)
+	l.burst = max(l.rate, minBurst)
+	l.tokens = min(l.tokens, l.burst)
+}
+
+// change rate (on config reload)
+func (l *Limiter) SetRate(rate int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.refill(l.now())
+	l.setRate(rate)
+}
+
+func (l *Limiter) Rate() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return int64(l.rate)
+}
+
+// must be called with lock held
+func (l *Limiter) refill(now time.Time) {
+	elapsed := now.Sub(l.last).Seconds()
+	l.last = now
+	if elapsed > 0 {
+		l.tokens = min(l.burst, l.tokens+elapsed*l.rate)
+	}
+}
+
+// take n tokens, sleeping while bucket is in debt
+func (l *Limiter) Wait(n int) {
+	l.lock.Lock()
+	l.refill(l.now())
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.lock.Unlock()
+	if delay > 0 {
+		l.sleep(delay)
+	}
+}
+
+// Limiters shared by key (user name for example)
+type Registry[K comparable] struct {
+	lock     sync.Mutex
+	limiters map[K]*Limiter
+}
+
+func NewRegistry[K comparable]() *Registry[K] {
+	return &Registry[K]{limiters: map[K]*Limiter{}}
+}
+
+// limiter for key with rate, nil if rate is 0 (unlimited). Rate of existing
+// limiter is updated.
+func (r *Registry[K]) Get(key K, rate int64) *Limiter {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	l, ok := r.limiters[key]
+	if rate <= 0 {
+		if ok {
+			delete(r.limiters, key)
+		}
+		return nil
+	}
+	if !ok {
+		l = New(rate)
+		r.limiters[key] = l
+	} else if l.Rate() != rate {
+		l.SetRate(rate)
+	}
+	return l
+}
@@ -0,0 +1,51 @@
+package rate_limit
+
+import (
+	"testing"
+	"time"
+)
+
+// limiter with fake clock, sleeping advances clock
+func testLimiter(rate int64) (*Limiter, *time.Duration) {
+	now := time.Unix(0, 0)
+	var slept time.Duration
+	l := New(rate)
+	l.now = func() time.Time { return now }
+	l.last = now
+	l.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+	return l, &slept
+}
+
+func TestLimiterRate(t *testing.T) {
+	const rate = 1 << 20
+	l, slept := testLimiter(rate)
+	// burst passes without waiting
+	l.Wait(rate)
+	if *slept != 0 {
+		t.Errorf("burst was delayed by %v", *slept)
+	}
+	// next 4 MB take 4 seconds
+	for i := 0; i < 64; i++ {
+		l.Wait(rate / 16)
+	}
+	if *slept < 3900*time.Millisecond || *slept > 4100*time.Millisecond {
+		t.Errorf("unexpected delay %v", *slept)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry[string]()
+	if r.Get("a", 0) != nil {
+		t.Errorf("limiter created for unlimited rate")
+	}
+	a := r.Get("a", 100)
+	if r.Get("a", 200) != a || a.Rate() != 200 {
+		t.Errorf("limiter not shared or rate not updated")
+	}
+	if r.Get("b", 100) == a {
+		t.Errorf("limiter shared between keys")
+	}
+}
@@ -1,6 +1,12 @@
 package stats
 
-import "net"
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
+)
 
 type ClientState uint8
 
@@ -15,12 +21,94 @@ const (
 	Authorized
 )
 
-// TODO: use atomics, stats does not need to be precise
+// Reason of connection close
+type CloseReason string
+
+const (
+	ReasonClosed           CloseReason = "closed"
+	ReasonHandshakeTimeout CloseReason = "handshake_timeout"
+	ReasonDcConnectTimeout CloseReason = "dc_connect_timeout"
+	ReasonIdleTimeout      CloseReason = "idle_timeout"
+	ReasonBanned           CloseReason = "banned"
+	ReasonIPLimit          CloseReason = "ip_limit"
+	ReasonDcError          CloseReason = "dc_error"
+	ReasonKicked           CloseReason = "kicked"
+	ReasonUserChanged      CloseReason = "user_changed"
+	ReasonQuotaExceeded    CloseReason = "quota_exceeded"
+	ReasonMaxConnections   CloseReason = "max_connections"
+	ReasonMaxIPs           CloseReason = "max_ips"
+	ReasonUserExpired      CloseReason = "user_expired"
+	ReasonUserDisabled     CloseReason = "user_disabled"
+	ReasonIPNotAllowed     CloseReason = "ip_not_allowed"
+	ReasonDcNotAllowed     CloseReason = "dc_not_allowed"
+)
+
+// Client connection. Traffic counters are atomic and updated without stats
+// lock, other fields are protected by it.
 type Client struct {
-	Name    *string
-	cliSock *net.TCPConn
-	state   ClientState
-	flags   ConnectionFlags
+	id       uint64
+	Name     *string
+	cliSock  net.Conn
+	listener string
+	started  time.Time
+	state    ClientState
+	flags    ConnectionFlags
+	reason   CloseReason
+	// known after handshake
+	transport string
+	protocol  string
+	dc        int16
+	egress    string
+	secret    string
+	// client to dc and dc to client traffic
+	bytesUp, bytesDown atomic.Uint64
+	msgsUp, msgsDown   atomic.Uint64
+	// traffic already excluded from user totals by reset
+	resetBase Traffic
+	// quota usage of user, set on authorization
+	usage *userUsage
+}
+
+// Result of client handshake
+type HandshakeOutcome string
+
+const (
+	HandshakeOk       HandshakeOutcome = "ok"
+	HandshakeFallback HandshakeOutcome = "fallback"
+	HandshakeFailed   HandshakeOutcome = "failed"
+	HandshakeTimeout  HandshakeOutcome = "timeout"
+	HandshakeBanned   HandshakeOutcome = "banned"
+	HandshakeIPLimit  HandshakeOutcome = "ip_limit"
+	// user matched, but refused by its limits
+	HandshakeRefused HandshakeOutcome = "refused"
+)
+
+// outcome of connection closed before handshake completion
+func failedOutcome(reason CloseReason) HandshakeOutcome {
+	switch reason {
+	case ReasonHandshakeTimeout:
+		return HandshakeTimeout
+	case ReasonBanned:
+		return HandshakeBanned
+	case ReasonIPLimit:
+		return HandshakeIPLimit
+	case ReasonQuotaExceeded, ReasonMaxConnections, ReasonMaxIPs, ReasonIPNotAllowed, ReasonDcNotAllowed:
+		return HandshakeRefused
+	default:
+		return HandshakeFailed
+	}
+}
+
+type egressKey struct {
+	egress string
+	dc     int16
+}
+
+func compareEgressKeys(a, b egressKey) int {
+	if a.egress != b.egress {
+		return strings.Compare(a.egress, b.egress)
+	}
+	return int(a.dc) - int(b.dc)
 }
 
 type StatsHandle struct {
@@ -28,24 +116,134 @@ type StatsHandle struct {
 	client *Client
 }
 
-func newClient() *Client {
+func newClient(id uint64, cliSock net.Conn, listener string) *Client {
 	return &Client{
-		state: None,
+		id:       id,
+		cliSock:  cliSock,
+		listener: listener,
+		started:  time.Now(),
+		state:    None,
 	}
 }
 
+// unique connection id
+func (sh *StatsHandle) ID() uint64 {
+	return sh.client.id
+}
+
 func (sh *StatsHandle) Close() {
 	sh.stats.removeClient(sh.client)
 }
 
 func (sh *StatsHandle) SetAuthorized(name string) {
 	sh.stats.lock.Lock()
+	sh.setAuthorizedLocked(name)
+	sh.stats.lock.Unlock()
+}
+
+// must be called with stats lock held for writing
+func (sh *StatsHandle) setAuthorizedLocked(name string) {
 	sh.client.Name = &name
 	sh.client.state = Authorized
+	sh.stats.handshakes[HandshakeOk]++
+	totals := sh.stats.userTotals[name]
+	totals.Sessions++
+	if sh.client.secret != "" {
+		totals.touchSecret(sh.client.secret, time.Now())
+		u := totals.Secrets[sh.client.secret]
+		u.Sessions++
+		totals.Secrets[sh.client.secret] = u
+	}
+	sh.stats.userTotals[name] = totals
+	sh.client.usage = sh.stats.usageLocked(name, time.Now())
+}
+
+// Limits of user checked on authorization, zero values are unlimited
+type UserLimits struct {
+	Quota          uint64
+	QuotaPeriod    QuotaPeriod
+	MaxConnections int
+	MaxIPs         int
+}
+
+// authorize client as user if new session is within user's limits. Returns
+// reason of refusal, which is also set as close reason, or empty string.
+func (sh *StatsHandle) Authorize(name string, limits UserLimits) CloseReason {
+	sh.stats.lock.Lock()
+	defer sh.stats.lock.Unlock()
+	reason := sh.checkLimitsLocked(name, limits)
+	if reason == "" {
+		sh.setAuthorizedLocked(name)
+	}
+	return reason
+}
+
+// check if new session of user is within user's limits without authorizing
+// client. Refusal is recorded like in Authorize.
+func (sh *StatsHandle) CheckLimits(name string, limits UserLimits) CloseReason {
+	sh.stats.lock.Lock()
+	defer sh.stats.lock.Unlock()
+	return sh.checkLimitsLocked(name, limits)
+}
+
+// must be called with stats lock held for writing
+func (sh *StatsHandle) checkLimitsLocked(name string, limits UserLimits) CloseReason {
+	reason := sh.stats.checkLimitsLocked(sh.client, name, limits)
+	if reason != "" {
+		sh.refuseLocked(name, reason)
+	}
+	return reason
+}
+
+// refuse session of matched user before authorization, reason is counted
+// with user's refusals and set as close reason
+func (sh *StatsHandle) Refuse(name string, reason CloseReason) {
+	sh.stats.lock.Lock()
+	sh.refuseLocked(name, reason)
 	sh.stats.lock.Unlock()
 }
 
-func (sh *StatsHandle) SetConnected(cliSock *net.TCPConn) {
+// must be called with stats lock held for writing
+func (sh *StatsHandle) refuseLocked(name string, reason CloseReason) {
+	sh.stats.refusals[refusalKey{name, reason}]++
+	if sh.client.reason == "" {
+		sh.client.reason = reason
+	}
+}
+
+// must be called with stats lock held for writing
+func (s *Stats) checkLimitsLocked(client *Client, name string, limits UserLimits) CloseReason {
+	if limits.Quota > 0 && s.quotaUsageLocked(name, limits.QuotaPeriod) >= limits.Quota {
+		return ReasonQuotaExceeded
+	}
+	if limits.MaxConnections <= 0 && limits.MaxIPs <= 0 {
+		return ""
+	}
+	connections := 0
+	ips := map[netip.Addr]bool{}
+	for _, c := range s.clients {
+		if c.isUser(name) {
+			connections++
+			if ip, ok := c.remoteIP(); ok {
+				ips[ip] = true
+			}
+		}
+	}
+	if limits.MaxConnections > 0 && connections >= limits.MaxConnections {
+		return ReasonMaxConnections
+	}
+	if ip, ok := client.remoteIP(); ok && limits.MaxIPs > 0 && !ips[ip] && len(ips) >= limits.MaxIPs {
+		return ReasonMaxIPs
+	}
+	return ""
+}
+
+type refusalKey struct {
+	user   string
+	reason CloseReason
+}
+
+func (sh *StatsHandle) SetConnected(cliSock net.Conn) {
 	sh.stats.lock.Lock()
 	sh.client.cliSock = cliSock
 	sh.client.state = Connected
@@ -54,10 +252,132 @@ func (sh *StatsHandle) SetConnected(cliSock *net.TCPConn) {
 
 func (sh *StatsHandle) SetState(state ClientState) {
 	sh.stats.lock.Lock()
+	if state == Fallback && sh.client.state != Fallback {
+		sh.stats.handshakes[HandshakeFallback]++
+	}
 	sh.client.state = state
 	sh.stats.lock.Unlock()
 }
 
+// set session parameters known after handshake
+func (sh *StatsHandle) SetSession(transport, protocol string, dc int16) {
+	sh.stats.lock.Lock()
+	sh.client.transport = transport
+	sh.client.protocol = protocol
+	sh.client.dc = dc
+	sh.stats.lock.Unlock()
+}
+
+// set label of user's secret matched on handshake, must be called before
+// Authorize to be counted
+func (sh *StatsHandle) SetSecret(label string) {
+	sh.stats.lock.Lock()
+	sh.client.secret = label
+	sh.stats.lock.Unlock()
+}
+
+// set egress type: direct, socks or middle
+func (sh *StatsHandle) SetEgress(egress string) {
+	sh.stats.lock.Lock()
+	sh.client.egress = egress
+	sh.stats.lock.Unlock()
+}
+
+// count failed connection to dc using session's egress and dc
+func (sh *StatsHandle) CountConnectError() {
+	sh.stats.lock.Lock()
+	sh.stats.connectErrors[egressKey{sh.client.egress, sh.client.dc}]++
+	sh.stats.lock.Unlock()
+}
+
+// record time spent on matching client handshake with user secrets
+func (sh *StatsHandle) ObserveHandshake(d time.Duration) {
+	sh.stats.lock.Lock()
+	sh.stats.handshakeTime.observe(d)
+	sh.stats.lock.Unlock()
+}
+
+// record time of successful connection to dc using session's egress and dc
+func (sh *StatsHandle) ObserveConnect(d time.Duration) {
+	sh.stats.lock.Lock()
+	key := egressKey{sh.client.egress, sh.client.dc}
+	h := sh.stats.connectTime[key]
+	if h == nil {
+		h = newHistogram(latencyBuckets)
+		sh.stats.connectTime[key] = h
+	}
+	h.observe(d)
+	sh.stats.lock.Unlock()
+}
+
+// record time of successful middle proxy login
+func (sh *StatsHandle) ObserveMiddleLogin(d time.Duration) {
+	sh.stats.lock.Lock()
+	sh.stats.middleLoginTime.observe(d)
+	sh.stats.lock.Unlock()
+}
+
+// count client to dc traffic
+func (sh *StatsHandle) CountUp(bytes, msgs int) {
+	sh.client.bytesUp.Add(uint64(bytes))
+	sh.client.msgsUp.Add(uint64(msgs))
+	if sh.client.usage != nil {
+		sh.client.usage.add(bytes)
+	}
+}
+
+// count dc to client traffic
+func (sh *StatsHandle) CountDown(bytes, msgs int) {
+	sh.client.bytesDown.Add(uint64(bytes))
+	sh.client.msgsDown.Add(uint64(msgs))
+	if sh.client.usage != nil {
+		sh.client.usage.add(bytes)
+	}
+}
+
+func (c *Client) isUser(name string) bool {
+	return c.Name != nil && *c.Name == name
+}
+
+// ip address of client, unix socket clients have no address
+func (c *Client) remoteIP() (netip.Addr, bool) {
+	if c.cliSock == nil {
+		return netip.Addr{}, false
+	}
+	addr, err := netip.ParseAddrPort(c.cliSock.RemoteAddr().String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Addr().Unmap(), true
+}
+
+// current traffic of connection
+func (c *Client) traffic() Traffic {
+	return Traffic{
+		BytesUp:   c.bytesUp.Load(),
+		BytesDown: c.bytesDown.Load(),
+		MsgsUp:    c.msgsUp.Load(),
+		MsgsDown:  c.msgsDown.Load(),
+	}
+}
+
+// traffic of connection counted in user totals. Must be called with stats
+// lock held.
+func (c *Client) accountedTraffic() Traffic {
+	t := c.traffic()
+	t.Sub(c.resetBase)
+	return t
+}
+
+// set reason of connection close. First reason is kept.
+func (sh *StatsHandle) SetCloseReason(reason CloseReason) {
+	sh.stats.lock.Lock()
+	if sh.client.reason == "" {
+		sh.client.reason = reason
+	}
+	sh.stats.lock.Unlock()
+}
+
 func (sh *StatsHandle) OrFlags(flags ConnectionFlags) {
 	sh.stats.lock.Lock()
 	sh.client.flags.FakeTls = sh.client.flags.FakeTls || flags.FakeTls
@@ -0,0 +1,105 @@
+package stats
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+// bucket bounds in seconds
+var (
+	latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	sessionBuckets = []float64{1, 10, 60, 300, 900, 3600, 3 * 3600, 12 * 3600, 24 * 3600}
+)
+
+// histogram of durations. Not safe for concurrent use, it's protected by
+// stats lock.
+type histogram struct {
+	bounds []float64
+	// counts by bucket, last one is for values over all bounds
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	i, _ := slices.BinarySearch(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// Bucket of histogram snapshot with cumulative count of values less or equal
+// than Le seconds
+type Bucket struct {
+	Le    float64 `json:"le"`
+	Count uint64  `json:"count"`
+}
+
+// Histogram snapshot, values are in seconds. Count includes values over the
+// last bucket bound.
+type Histogram struct {
+	Buckets []Bucket `json:"buckets"`
+	Sum     float64  `json:"sum"`
+	Count   uint64   `json:"count"`
+}
+
+func (h *histogram) snapshot() Histogram {
+	snap := Histogram{
+		Buckets: make([]Bucket, 0, len(h.bounds)),
+		Sum:     h.sum,
+		Count:   h.count,
+	}
+	cumulative := uint64(0)
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		snap.Buckets = append(snap.Buckets, Bucket{Le: bound, Count: cumulative})
+	}
+	return snap
+}
+
+// upper bound of bucket containing quantile q, infinity if it's over all
+// bounds, 0 for empty histogram
+func (h Histogram) Quantile(q float64) float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(h.Count)))
+	for _, b := range h.Buckets {
+		if b.Count >= rank {
+			return b.Le
+		}
+	}
+	return math.Inf(1)
+}
+
+// short text with count, average and quantiles
+func (h Histogram) String() string {
+	if h.Count == 0 {
+		return "count 0"
+	}
+	seconds := func(v float64) time.Duration {
+		return time.Duration(v * float64(time.Second))
+	}
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "count %d, avg %s", h.Count, seconds(h.Sum/float64(h.Count)).Round(time.Microsecond))
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		v := h.Quantile(q)
+		if math.IsInf(v, 1) && len(h.Buckets) > 0 {
+			fmt.Fprintf(b, ", p%g >%s", q*100, seconds(h.Buckets[len(h.Buckets)-1].Le))
+		} else {
+			fmt.Fprintf(b, ", p%g <=%s", q*100, seconds(v))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,36 @@
+package stats
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{0.01, 0.1, 1})
+	for _, d := range []time.Duration{
+		5 * time.Millisecond,
+		10 * time.Millisecond,
+		50 * time.Millisecond,
+		500 * time.Millisecond,
+		2 * time.Second,
+	} {
+		h.observe(d)
+	}
+	snap := h.snapshot()
+	want := []uint64{2, 3, 4}
+	for i, b := range snap.Buckets {
+		if b.Count != want[i] {
+			t.Errorf("bucket %g has %d values, want %d", b.Le, b.Count, want[i])
+		}
+	}
+	if snap.Count != 5 || math.Abs(snap.Sum-2.565) > 1e-9 {
+		t.Errorf("wrong count %d or sum %g", snap.Count, snap.Sum)
+	}
+	if snap.Quantile(0.4) != 0.01 || snap.Quantile(0.5) != 0.1 || !math.IsInf(snap.Quantile(0.99), 1) {
+		t.Errorf("wrong quantiles")
+	}
+	if (Histogram{}).Quantile(0.5) != 0 {
+		t.Errorf("quantile of empty histogram")
+	}
+}
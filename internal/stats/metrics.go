@@ -0,0 +1,185 @@
+package stats
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// content type of prometheus text exposition format
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Writer of prometheus text exposition format. First write error is kept and
+// following writes are skipped.
+type MetricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func NewMetricsWriter(w io.Writer) *MetricsWriter {
+	return &MetricsWriter{w: w}
+}
+
+func (m *MetricsWriter) Err() error {
+	return m.err
+}
+
+// start metric family, kind is gauge or counter
+func (m *MetricsWriter) Family(name, kind, help string) {
+	if m.err != nil {
+		return
+	}
+	_, m.err = fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// write sample of current family, labels are name and value pairs
+func (m *MetricsWriter) Sample(name string, value float64, labels ...string) {
+	if m.err != nil {
+		return
+	}
+	b := &strings.Builder{}
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	b.WriteByte('\n')
+	_, m.err = io.WriteString(m.w, b.String())
+}
+
+// write buckets, sum and count samples of histogram
+func (m *MetricsWriter) Histogram(name string, h Histogram, labels ...string) {
+	for _, b := range h.Buckets {
+		le := strconv.FormatFloat(b.Le, 'g', -1, 64)
+		m.Sample(name+"_bucket", float64(b.Count), append(slices.Clip(labels), "le", le)...)
+	}
+	m.Sample(name+"_bucket", float64(h.Count), append(slices.Clip(labels), "le", "+Inf")...)
+	m.Sample(name+"_sum", h.Sum, labels...)
+	m.Sample(name+"_count", float64(h.Count), labels...)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+// key of active connections gauge
+type connectionKey struct {
+	user, state, transport, dc string
+}
+
+// write metrics of client connections
+func (s *Stats) WriteMetrics(m *MetricsWriter) {
+	connections := map[connectionKey]int{}
+	s.lock.RLock()
+	for _, c := range s.clients {
+		key := connectionKey{state: c.state.String(), transport: c.transport}
+		if c.Name != nil {
+			key.user = *c.Name
+		}
+		if c.transport != "" {
+			key.dc = strconv.Itoa(int(c.dc))
+		}
+		connections[key]++
+	}
+	handshakes := maps.Clone(s.handshakes)
+	closeReasons := maps.Clone(s.closeReasons)
+	connectErrors := maps.Clone(s.connectErrors)
+	refusals := maps.Clone(s.refusals)
+	userTotals := s.userTotalsLocked()
+	s.lock.RUnlock()
+
+	m.Family("tgp_connections", "gauge", "Active client connections.")
+	keys := slices.SortedFunc(maps.Keys(connections), func(a, b connectionKey) int {
+		return strings.Compare(
+			a.user+"\x00"+a.state+"\x00"+a.transport+"\x00"+a.dc,
+			b.user+"\x00"+b.state+"\x00"+b.transport+"\x00"+b.dc)
+	})
+	for _, k := range keys {
+		m.Sample("tgp_connections", float64(connections[k]),
+			"user", k.user, "state", k.state, "transport", k.transport, "dc", k.dc)
+	}
+
+	m.Family("tgp_handshakes_total", "counter", "Finished client handshakes by outcome.")
+	for _, outcome := range slices.Sorted(maps.Keys(handshakes)) {
+		m.Sample("tgp_handshakes_total", float64(handshakes[outcome]), "outcome", string(outcome))
+	}
+
+	m.Family("tgp_closed_connections_total", "counter", "Closed client connections by reason.")
+	for _, reason := range slices.Sorted(maps.Keys(closeReasons)) {
+		m.Sample("tgp_closed_connections_total", float64(closeReasons[reason]), "reason", string(reason))
+	}
+
+	users := slices.Sorted(maps.Keys(userTotals))
+	m.Family("tgp_user_sessions_total", "counter", "Authorized sessions by user.")
+	for _, user := range users {
+		m.Sample("tgp_user_sessions_total", float64(userTotals[user].Sessions), "user", user)
+	}
+	m.Family("tgp_user_secret_sessions_total", "counter", "Authorized sessions by user and secret label.")
+	for _, user := range users {
+		secrets := userTotals[user].Secrets
+		for _, label := range slices.Sorted(maps.Keys(secrets)) {
+			m.Sample("tgp_user_secret_sessions_total", float64(secrets[label].Sessions), "user", user, "secret", label)
+		}
+	}
+	m.Family("tgp_user_secret_last_used_seconds", "gauge", "Unix time of last use of user's secret.")
+	for _, user := range users {
+		secrets := userTotals[user].Secrets
+		for _, label := range slices.Sorted(maps.Keys(secrets)) {
+			m.Sample("tgp_user_secret_last_used_seconds", float64(secrets[label].LastUsed.Unix()), "user", user, "secret", label)
+		}
+	}
+	m.Family("tgp_user_bytes_total", "counter", "Relayed bytes by user and direction.")
+	for _, user := range users {
+		t := userTotals[user]
+		m.Sample("tgp_user_bytes_total", float64(t.BytesUp), "user", user, "direction", "up")
+		m.Sample("tgp_user_bytes_total", float64(t.BytesDown), "user", user, "direction", "down")
+	}
+	m.Family("tgp_user_messages_total", "counter", "Relayed middle proxy messages by user and direction.")
+	for _, user := range users {
+		t := userTotals[user]
+		m.Sample("tgp_user_messages_total", float64(t.MsgsUp), "user", user, "direction", "up")
+		m.Sample("tgp_user_messages_total", float64(t.MsgsDown), "user", user, "direction", "down")
+	}
+
+	m.Family("tgp_user_refused_total", "counter", "Refused sessions of identified users by reason.")
+	refusalKeys := slices.SortedFunc(maps.Keys(refusals), func(a, b refusalKey) int {
+		if a.user != b.user {
+			return strings.Compare(a.user, b.user)
+		}
+		return strings.Compare(string(a.reason), string(b.reason))
+	})
+	for _, k := range refusalKeys {
+		m.Sample("tgp_user_refused_total", float64(refusals[k]), "user", k.user, "reason", string(k.reason))
+	}
+
+	m.Family("tgp_dc_connect_errors_total", "counter", "Failed connections to DC by egress (direct, socks or middle).")
+	for _, k := range slices.SortedFunc(maps.Keys(connectErrors), compareEgressKeys) {
+		m.Sample("tgp_dc_connect_errors_total", float64(connectErrors[k]),
+			"egress", k.egress, "dc", strconv.Itoa(int(k.dc)))
+	}
+
+	latency := s.Latency()
+	m.Family("tgp_handshake_seconds", "histogram", "Time of matching client handshake with user secrets.")
+	m.Histogram("tgp_handshake_seconds", latency.Handshake)
+	m.Family("tgp_dc_connect_seconds", "histogram", "Time of successful connection to DC by egress (direct, socks or middle).")
+	for _, c := range latency.Connect {
+		m.Histogram("tgp_dc_connect_seconds", c.Histogram, "egress", c.Egress, "dc", strconv.Itoa(int(c.DC)))
+	}
+	m.Family("tgp_middle_proxy_login_seconds", "histogram", "Time of successful middle proxy login.")
+	m.Histogram("tgp_middle_proxy_login_seconds", latency.MiddleLogin)
+	m.Family("tgp_session_duration_seconds", "histogram", "Duration of authorized sessions.")
+	m.Histogram("tgp_session_duration_seconds", latency.Session)
+}
@@ -0,0 +1,56 @@
+package stats
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	s := New()
+	authorized := s.AllocClient(nil, "test")
+	authorized.SetSession("obfuscated", "intermediate", 2)
+	authorized.SetAuthorized("user")
+	authorized.CountUp(100, 0)
+	fallback := s.AllocClient(nil, "test")
+	fallback.SetState(Fallback)
+	fallback.Close()
+	timeout := s.AllocClient(nil, "test")
+	timeout.SetCloseReason(ReasonHandshakeTimeout)
+	timeout.Close()
+	authorized.SetEgress("direct")
+	authorized.CountConnectError()
+	authorized.ObserveConnect(30 * time.Millisecond)
+	b := &strings.Builder{}
+	m := NewMetricsWriter(b)
+	s.WriteMetrics(m)
+	if m.Err() != nil {
+		t.Fatalf("metrics not written: %v", m.Err())
+	}
+	out := b.String()
+	for _, line := range []string{
+		"# TYPE tgp_connections gauge",
+		`tgp_connections{user="user",state="authorized",transport="obfuscated",dc="2"} 1`,
+		`tgp_handshakes_total{outcome="fallback"} 1`,
+		`tgp_handshakes_total{outcome="ok"} 1`,
+		`tgp_handshakes_total{outcome="timeout"} 1`,
+		`tgp_user_bytes_total{user="user",direction="up"} 100`,
+		`tgp_dc_connect_errors_total{egress="direct",dc="2"} 1`,
+		"# TYPE tgp_dc_connect_seconds histogram",
+		`tgp_dc_connect_seconds_bucket{egress="direct",dc="2",le="0.025"} 0`,
+		`tgp_dc_connect_seconds_bucket{egress="direct",dc="2",le="0.05"} 1`,
+		`tgp_dc_connect_seconds_bucket{egress="direct",dc="2",le="+Inf"} 1`,
+		`tgp_dc_connect_seconds_count{egress="direct",dc="2"} 1`,
+		`tgp_session_duration_seconds_count 0`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("metrics output has no line %q:\n%s", line, out)
+		}
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	if escapeLabel("a\"b\\c\nd") != `a\"b\\c\nd` {
+		t.Errorf("label not escaped")
+	}
+}
@@ -0,0 +1,110 @@
+package stats
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Period of traffic quota
+type QuotaPeriod string
+
+const (
+	QuotaDaily   QuotaPeriod = "daily"
+	QuotaMonthly QuotaPeriod = "monthly"
+)
+
+// start of period containing t in local time
+func (p QuotaPeriod) start(t time.Time) time.Time {
+	y, m, d := t.Date()
+	if p == QuotaDaily {
+		return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	}
+	return time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+}
+
+// Traffic of user (both directions) in period started at Start
+type PeriodUsage struct {
+	Start time.Time `json:"start"`
+	Bytes uint64    `json:"bytes"`
+}
+
+// Traffic of user in current day and month. Counters are updated by relay
+// without lock, period starts are protected by stats lock.
+type userUsage struct {
+	day, month           atomic.Uint64
+	dayStart, monthStart time.Time
+}
+
+func newUserUsage(now time.Time) *userUsage {
+	return &userUsage{
+		dayStart:   QuotaDaily.start(now),
+		monthStart: QuotaMonthly.start(now),
+	}
+}
+
+func (u *userUsage) add(n int) {
+	u.day.Add(uint64(n))
+	u.month.Add(uint64(n))
+}
+
+// start new periods if they are over. Must be called with stats lock held
+// for writing.
+func (u *userUsage) rollover(now time.Time) {
+	if start := QuotaDaily.start(now); !start.Equal(u.dayStart) {
+		u.dayStart = start
+		u.day.Store(0)
+	}
+	if start := QuotaMonthly.start(now); !start.Equal(u.monthStart) {
+		u.monthStart = start
+		u.month.Store(0)
+	}
+}
+
+// usage in current periods. Must be called with stats lock held.
+func (u *userUsage) current(now time.Time) (day, month PeriodUsage) {
+	day = PeriodUsage{Start: QuotaDaily.start(now)}
+	if day.Start.Equal(u.dayStart) {
+		day.Bytes = u.day.Load()
+	}
+	month = PeriodUsage{Start: QuotaMonthly.start(now)}
+	if month.Start.Equal(u.monthStart) {
+		month.Bytes = u.month.Load()
+	}
+	return
+}
+
+// usage of user, created on first use. Must be called with stats lock held
+// for writing.
+func (s *Stats) usageLocked(name string, now time.Time) *userUsage {
+	u, ok := s.usage[name]
+	if !ok {
+		u = newUserUsage(now)
+		s.usage[name] = u
+	}
+	return u
+}
+
+// traffic of user in current period
+func (s *Stats) QuotaUsage(name string, period QuotaPeriod) uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.quotaUsageLocked(name, period)
+}
+
+// must be called with stats lock held for writing
+func (s *Stats) quotaUsageLocked(name string, period QuotaPeriod) uint64 {
+	u, ok := s.usage[name]
+	if !ok {
+		return 0
+	}
+	u.rollover(time.Now())
+	if period == QuotaDaily {
+		return u.day.Load()
+	}
+	return u.month.Load()
+}
+
+// check if user used quota bytes in current period. Zero quota is unlimited.
+func (s *Stats) OverQuota(name string, quota uint64, period QuotaPeriod) bool {
+	return quota > 0 && s.QuotaUsage(name, period) >= quota
+}
@@ -0,0 +1,36 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuotaPeriodStart(t *testing.T) {
+	now := time.Date(2024, 2, 29, 13, 14, 15, 0, time.UTC)
+	if !QuotaDaily.start(now).Equal(time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("wrong start of day")
+	}
+	if !QuotaMonthly.start(now).Equal(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("wrong start of month")
+	}
+}
+
+func TestOverQuota(t *testing.T) {
+	s := New()
+	h := s.AllocClient(nil, "test")
+	h.SetAuthorized("user")
+	h.CountUp(60, 1)
+	h.CountDown(40, 1)
+	if !s.OverQuota("user", 100, QuotaDaily) || s.OverQuota("user", 101, QuotaMonthly) {
+		t.Errorf("quota usage not counted")
+	}
+	if s.OverQuota("user", 0, QuotaDaily) || s.OverQuota("other", 1, QuotaDaily) {
+		t.Errorf("unexpected quota exceeding")
+	}
+	// usage of previous day is dropped
+	u := s.usage["user"]
+	u.dayStart = u.dayStart.AddDate(0, 0, -1)
+	if s.QuotaUsage("user", QuotaDaily) != 0 || s.QuotaUsage("user", QuotaMonthly) != 100 {
+		t.Errorf("daily usage not rolled over")
+	}
+}
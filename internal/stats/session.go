@@ -0,0 +1,147 @@
+package stats
+
+import "time"
+
+// Snapshot of client connection
+type ClientInfo struct {
+	ID uint64 `json:"id"`
+	// connection start and duration in seconds
+	Start     time.Time `json:"start"`
+	Duration  float64   `json:"duration"`
+	User      string    `json:"user,omitempty"`
+	Remote    string    `json:"remote"`
+	Listener  string    `json:"listener"`
+	State     string    `json:"state"`
+	Transport string    `json:"transport,omitempty"`
+	Protocol  string    `json:"protocol,omitempty"`
+	DC        int16     `json:"dc,omitempty"`
+	Egress    string    `json:"egress,omitempty"`
+	// label of user's secret matched on handshake
+	Secret string `json:"secret,omitempty"`
+	Traffic
+}
+
+// Summary of finished client session
+type Session struct {
+	ClientInfo
+	End         time.Time   `json:"end"`
+	CloseReason CloseReason `json:"close_reason"`
+}
+
+// Amount of relayed data. Messages are counted only where protocol framing is
+// parsed (middle proxy sessions).
+type Traffic struct {
+	BytesUp   uint64 `json:"bytes_up"`
+	BytesDown uint64 `json:"bytes_down"`
+	MsgsUp    uint64 `json:"msgs_up"`
+	MsgsDown  uint64 `json:"msgs_down"`
+}
+
+func (t *Traffic) Add(other Traffic) {
+	t.BytesUp += other.BytesUp
+	t.BytesDown += other.BytesDown
+	t.MsgsUp += other.MsgsUp
+	t.MsgsDown += other.MsgsDown
+}
+
+func (t *Traffic) Sub(other Traffic) {
+	t.BytesUp -= other.BytesUp
+	t.BytesDown -= other.BytesDown
+	t.MsgsUp -= other.MsgsUp
+	t.MsgsDown -= other.MsgsDown
+}
+
+// Cumulative accounting of user
+type UserTotals struct {
+	// number of authorized sessions
+	Sessions uint64 `json:"sessions"`
+	Traffic
+	// traffic in current quota periods
+	Day   PeriodUsage `json:"day"`
+	Month PeriodUsage `json:"month"`
+	// usage of user's secrets by label
+	Secrets map[string]SecretUsage `json:"secrets,omitempty"`
+}
+
+// Usage of one of user's secrets. LastUsed is time of last authorization or
+// session end, it's current time while sessions are active.
+type SecretUsage struct {
+	// active connections, not kept in state
+	Connections int       `json:"connections,omitempty"`
+	Sessions    uint64    `json:"sessions"`
+	LastUsed    time.Time `json:"last_used"`
+}
+
+// add usage of secrets loaded from saved state
+func (t *UserTotals) addSecrets(secrets map[string]SecretUsage) {
+	for label, other := range secrets {
+		t.touchSecret(label, other.LastUsed)
+		u := t.Secrets[label]
+		u.Sessions += other.Sessions
+		t.Secrets[label] = u
+	}
+}
+
+// update last use of secret. Map is modified in place, clone totals before.
+func (t *UserTotals) touchSecret(label string, now time.Time) {
+	if t.Secrets == nil {
+		t.Secrets = map[string]SecretUsage{}
+	}
+	u := t.Secrets[label]
+	if now.After(u.LastUsed) {
+		u.LastUsed = now
+	}
+	t.Secrets[label] = u
+}
+
+func (s ClientState) String() string {
+	switch s {
+	case None:
+		return "none"
+	case Connected:
+		return "connected"
+	case Fallback:
+		return "fallback"
+	case Authorized:
+		return "authorized"
+	default:
+		return "unknown"
+	}
+}
+
+// build connection snapshot. Must be called with stats lock held.
+func (c *Client) info(now time.Time) ClientInfo {
+	i := ClientInfo{
+		ID:        c.id,
+		Start:     c.started,
+		Duration:  now.Sub(c.started).Seconds(),
+		Listener:  c.listener,
+		State:     c.state.String(),
+		Transport: c.transport,
+		Protocol:  c.protocol,
+		DC:        c.dc,
+		Egress:    c.egress,
+		Secret:    c.secret,
+		Traffic:   c.traffic(),
+	}
+	if c.Name != nil {
+		i.User = *c.Name
+	}
+	if c.cliSock != nil {
+		i.Remote = c.cliSock.RemoteAddr().String()
+	}
+	return i
+}
+
+// build session record. Must be called with stats lock held.
+func (c *Client) session(end time.Time) Session {
+	s := Session{
+		ClientInfo:  c.info(end),
+		End:         end,
+		CloseReason: c.reason,
+	}
+	if s.CloseReason == "" {
+		s.CloseReason = ReasonClosed
+	}
+	return s
+}
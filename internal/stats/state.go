@@ -0,0 +1,64 @@
+package stats
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// content of state file
+type savedState struct {
+	Saved time.Time             `json:"saved"`
+	Users map[string]UserTotals `json:"users"`
+}
+
+// write cumulative user totals to file. File is replaced atomically.
+func (s *Stats) SaveState(path string) error {
+	data, err := json.MarshalIndent(savedState{
+		Saved: time.Now().UTC(),
+		Users: s.UserTotals(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("can't create state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(append(data, '\n'))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("can't write state file: %w", err)
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return fmt.Errorf("can't replace state file: %w", err)
+	}
+	return nil
+}
+
+// add user totals saved in file. Missing file is not an error.
+func (s *Stats) LoadState(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("can't read state file: %w", err)
+	}
+	var state savedState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return fmt.Errorf("can't parse state file %s: %w", path, err)
+	}
+	s.AddUserTotals(state.Users)
+	return nil
+}
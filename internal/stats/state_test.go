@@ -0,0 +1,57 @@
+package stats
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestStateSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s := New()
+	if err := s.LoadState(path); err != nil {
+		t.Fatalf("missing state file not ignored: %v", err)
+	}
+	h := s.AllocClient(nil, "test")
+	h.SetAuthorized("user")
+	h.CountUp(10, 1)
+	h.CountDown(20, 0)
+	// active connection is saved too
+	if err := s.SaveState(path); err != nil {
+		t.Fatalf("state not saved: %v", err)
+	}
+	loaded := New()
+	if err := loaded.LoadState(path); err != nil {
+		t.Fatalf("state not loaded: %v", err)
+	}
+	totals := loaded.UserTotals()["user"]
+	expected := Traffic{BytesUp: 10, BytesDown: 20, MsgsUp: 1}
+	if totals.Sessions != 1 || totals.Traffic != expected {
+		t.Errorf("unexpected loaded totals %+v", totals)
+	}
+	if totals.Day.Bytes != 30 || totals.Month.Bytes != 30 {
+		t.Errorf("quota usage not loaded: %+v", totals)
+	}
+}
+
+func TestResetUserTotals(t *testing.T) {
+	s := New()
+	h := s.AllocClient(nil, "test")
+	h.SetAuthorized("a")
+	h.CountUp(10, 0)
+	s.AddUserTotals(map[string]UserTotals{"b": {Sessions: 3}})
+	s.ResetUserTotals("a")
+	h.CountUp(5, 0)
+	if s.UserTotals()["a"].BytesUp != 5 || s.UserTotals()["b"].Sessions != 3 {
+		t.Errorf("user totals not reset correctly: %+v", s.UserTotals())
+	}
+	h.Close()
+	if s.UserTotals()["a"].BytesUp != 5 {
+		t.Errorf("traffic before reset counted on close")
+	}
+	s.ResetUserTotals("")
+	for name, totals := range s.UserTotals() {
+		if totals.Sessions != 0 || totals.Traffic != (Traffic{}) || totals.Month.Bytes != 0 {
+			t.Errorf("totals of user %s not reset: %+v", name, totals)
+		}
+	}
+}
@@ -1,25 +1,65 @@
 package stats
 
 import (
+	"cmp"
 	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Stats struct {
 	lock    sync.RWMutex
 	clients []*Client
+	lastID  atomic.Uint64
+	// number of closed connections by reason
+	closeReasons map[CloseReason]int
+	// sessions and traffic of closed connections by user
+	userTotals map[string]UserTotals
+	// quota usage by user
+	usage map[string]*userUsage
+	// refused sessions of known users by reason
+	refusals map[refusalKey]uint64
+	// handshake outcomes of all connections
+	handshakes map[HandshakeOutcome]uint64
+	// failed connections to dc by egress and dc
+	connectErrors map[egressKey]uint64
+	// latency of secret matching, connect to dc by egress and dc, middle proxy
+	// login and duration of authorized sessions
+	handshakeTime   *histogram
+	connectTime     map[egressKey]*histogram
+	middleLoginTime *histogram
+	sessionTime     *histogram
+	// called with record of every closed session
+	sessionLog func(Session)
 }
 
 func New() *Stats {
 	return &Stats{
-		lock:    sync.RWMutex{},
-		clients: []*Client{},
+		lock:            sync.RWMutex{},
+		clients:         []*Client{},
+		closeReasons:    map[CloseReason]int{},
+		userTotals:      map[string]UserTotals{},
+		usage:           map[string]*userUsage{},
+		refusals:        map[refusalKey]uint64{},
+		handshakes:      map[HandshakeOutcome]uint64{},
+		connectErrors:   map[egressKey]uint64{},
+		handshakeTime:   newHistogram(latencyBuckets),
+		connectTime:     map[egressKey]*histogram{},
+		middleLoginTime: newHistogram(latencyBuckets),
+		sessionTime:     newHistogram(sessionBuckets),
 	}
 }
 
-func (s *Stats) AllocClient() *StatsHandle {
-	client := newClient()
+// register new client connection. Connection is kept to be able to close it
+// forcibly.
+func (s *Stats) AllocClient(cliSock net.Conn, listener string) *StatsHandle {
+	client := newClient(s.lastID.Add(1), cliSock, listener)
 	s.lock.Lock()
 	s.clients = append(s.clients, client)
 	s.lock.Unlock()
@@ -30,35 +70,368 @@ func (s *Stats) AllocClient() *StatsHandle {
 	return clientHandle
 }
 
+// set function receiving records of closed sessions. Must be set before
+// clients are allocated.
+func (s *Stats) SetSessionLog(fn func(Session)) {
+	s.sessionLog = fn
+}
+
 func (s *Stats) removeClient(client *Client) {
 	s.lock.Lock()
-	defer s.lock.Unlock()
 	for i, c := range s.clients {
 		if c == client {
 			s.clients = append(s.clients[:i], s.clients[i+1:]...)
 			break
 		}
 	}
+	reason := client.reason
+	if reason == "" {
+		reason = ReasonClosed
+	}
+	s.closeReasons[reason]++
+	if client.state == None {
+		// handshake was not completed
+		s.handshakes[failedOutcome(reason)]++
+	}
+	now := time.Now()
+	if client.Name != nil {
+		t := s.userTotals[*client.Name]
+		t.Add(client.accountedTraffic())
+		if client.secret != "" {
+			t.touchSecret(client.secret, now)
+		}
+		s.userTotals[*client.Name] = t
+		s.sessionTime.observe(now.Sub(client.started))
+	}
+	var session Session
+	if s.sessionLog != nil {
+		session = client.session(now)
+	}
+	s.lock.Unlock()
+	if s.sessionLog != nil {
+		s.sessionLog(session)
+	}
 }
 
-func (s *Stats) AsString() string {
-	userStats := map[string]int{}
-	fallbacks := 0
-	// generate per-user stats
+// number of currently active clients
+func (s *Stats) Count() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.clients)
+}
+
+// wait until all clients are gone or timeout expires. Returns true if there
+// are no active clients left.
+func (s *Stats) WaitEmpty(timeout time.Duration) bool {
+	const pollInterval = 100 * time.Millisecond
+	deadline := time.Now().Add(timeout)
+	for s.Count() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(pollInterval)
+	}
+	return true
+}
+
+// close sockets of matching clients and set close reason if it's not empty.
+// Clients are removed from stats by their handlers.
+func (s *Stats) closeWhere(reason CloseReason, match func(c *Client) bool) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	closed := 0
+	for _, c := range s.clients {
+		if c.cliSock != nil && match(c) {
+			if reason != "" && c.reason == "" {
+				c.reason = reason
+			}
+			c.cliSock.Close()
+			closed++
+		}
+	}
+	return closed
+}
+
+// close sockets of all active clients
+func (s *Stats) CloseAll() int {
+	return s.closeWhere("", func(c *Client) bool { return true })
+}
+
+// names of users with active authorized connections
+func (s *Stats) ActiveUsers() []string {
 	s.lock.RLock()
+	defer s.lock.RUnlock()
+	seen := map[string]bool{}
+	users := []string{}
+	for _, c := range s.clients {
+		if c.Name != nil && !seen[*c.Name] {
+			seen[*c.Name] = true
+			users = append(users, *c.Name)
+		}
+	}
+	return users
+}
+
+// close sockets of all connections authorized as user
+func (s *Stats) CloseUser(name string, reason CloseReason) int {
+	return s.closeWhere(reason, func(c *Client) bool { return c.isUser(name) })
+}
+
+// close connection with id by admin request
+func (s *Stats) KickID(id uint64) int {
+	return s.closeWhere(ReasonKicked, func(c *Client) bool { return c.id == id })
+}
+
+// close connections of user by admin request
+func (s *Stats) KickUser(name string) int {
+	return s.CloseUser(name, ReasonKicked)
+}
+
+// close connections from ip by admin request
+func (s *Stats) KickIP(ip netip.Addr) int {
+	ip = ip.Unmap()
+	return s.closeWhere(ReasonKicked, func(c *Client) bool {
+		remote, ok := c.remoteIP()
+		return ok && remote == ip
+	})
+}
+
+// cumulative sessions and traffic by user including active connections
+func (s *Stats) UserTotals() map[string]UserTotals {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.userTotalsLocked()
+}
+
+func (s *Stats) userTotalsLocked() map[string]UserTotals {
+	result := maps.Clone(s.userTotals)
+	for name, t := range result {
+		t.Secrets = maps.Clone(t.Secrets)
+		result[name] = t
+	}
+	now := time.Now()
+	for _, c := range s.clients {
+		if c.Name != nil {
+			t := result[*c.Name]
+			t.Add(c.accountedTraffic())
+			if c.secret != "" {
+				t.touchSecret(c.secret, now)
+			}
+			result[*c.Name] = t
+		}
+	}
+	for name, u := range s.usage {
+		t := result[name]
+		t.Day, t.Month = u.current(now)
+		result[name] = t
+	}
+	return result
+}
+
+// cumulative traffic by user including active connections
+func (s *Stats) UserTraffic() map[string]Traffic {
+	result := map[string]Traffic{}
+	for name, t := range s.UserTotals() {
+		result[name] = t.Traffic
+	}
+	return result
+}
+
+// add totals loaded from saved state
+func (s *Stats) AddUserTotals(totals map[string]UserTotals) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	for name, t := range totals {
+		current := s.userTotals[name]
+		current.Sessions += t.Sessions
+		current.Add(t.Traffic)
+		current.addSecrets(t.Secrets)
+		s.userTotals[name] = current
+		// usage of periods that are already over is dropped
+		u := s.usageLocked(name, now)
+		u.rollover(now)
+		if t.Day.Start.Equal(u.dayStart) {
+			u.day.Add(t.Day.Bytes)
+		}
+		if t.Month.Start.Equal(u.monthStart) {
+			u.month.Add(t.Month.Bytes)
+		}
+	}
+}
+
+// clear cumulative totals of user, or of all users if name is empty. Traffic
+// of active connections is counted from this moment.
+func (s *Stats) ResetUserTotals(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if name == "" {
+		clear(s.userTotals)
+	} else {
+		delete(s.userTotals, name)
+	}
+	for n, u := range s.usage {
+		if name == "" || n == name {
+			u.day.Store(0)
+			u.month.Store(0)
+		}
+	}
+	for _, c := range s.clients {
+		if c.Name != nil && (name == "" || *c.Name == name) {
+			c.resetBase = c.traffic()
+		}
+	}
+}
+
+// Summary of all connections
+type Summary struct {
+	// active connections
+	Total     int            `json:"total"`
+	Users     map[string]int `json:"users"`
+	Fallbacks int            `json:"fallbacks"`
+	// cumulative counters
+	Traffic    map[string]Traffic          `json:"traffic"`
+	Handshakes map[HandshakeOutcome]uint64 `json:"handshakes"`
+	Closed     map[CloseReason]int         `json:"closed"`
+}
+
+func (s *Stats) Summary() Summary {
+	summary := Summary{Users: map[string]int{}}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	summary.Total = len(s.clients)
 	for _, c := range s.clients {
 		if c.Name != nil && *c.Name != "" {
-			userStats[*c.Name]++
+			summary.Users[*c.Name]++
 		} else if c.state == Fallback {
-			fallbacks++
+			summary.Fallbacks++
+		}
+	}
+	summary.Traffic = map[string]Traffic{}
+	for name, t := range s.userTotalsLocked() {
+		summary.Traffic[name] = t.Traffic
+	}
+	summary.Handshakes = maps.Clone(s.handshakes)
+	summary.Closed = maps.Clone(s.closeReasons)
+	return summary
+}
+
+// snapshots of active connections ordered by id
+func (s *Stats) Clients() []ClientInfo {
+	now := time.Now()
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	clients := make([]ClientInfo, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c.info(now))
+	}
+	slices.SortFunc(clients, func(a, b ClientInfo) int { return cmp.Compare(a.ID, b.ID) })
+	return clients
+}
+
+// Active connections and cumulative totals of user
+type UserInfo struct {
+	Connections int `json:"connections"`
+	UserTotals
+	// refused sessions by reason since start
+	Refused map[CloseReason]uint64 `json:"refused,omitempty"`
+	// account status from config, not filled by stats
+	Expires  *time.Time `json:"expires,omitempty"`
+	Disabled bool       `json:"disabled,omitempty"`
+}
+
+// info of users seen since start
+func (s *Stats) Users() map[string]UserInfo {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	users := map[string]UserInfo{}
+	for name, t := range s.userTotalsLocked() {
+		users[name] = UserInfo{UserTotals: t}
+	}
+	for _, c := range s.clients {
+		if c.Name != nil {
+			u := users[*c.Name]
+			u.Connections++
+			if c.secret != "" {
+				secret := u.Secrets[c.secret]
+				secret.Connections++
+				u.Secrets[c.secret] = secret
+			}
+			users[*c.Name] = u
+		}
+	}
+	for k, count := range s.refusals {
+		u := users[k.user]
+		if u.Refused == nil {
+			u.Refused = map[CloseReason]uint64{}
 		}
+		u.Refused[k.reason] = count
+		users[k.user] = u
 	}
-	s.lock.RUnlock()
+	return users
+}
+
+// Latency histograms, connect ones are by egress and dc
+type Latency struct {
+	Handshake   Histogram        `json:"handshake"`
+	Connect     []ConnectLatency `json:"connect"`
+	MiddleLogin Histogram        `json:"middle_login"`
+	Session     Histogram        `json:"session"`
+}
+
+type ConnectLatency struct {
+	Egress string `json:"egress"`
+	DC     int16  `json:"dc"`
+	Histogram
+}
+
+func (s *Stats) Latency() Latency {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	latency := Latency{
+		Handshake:   s.handshakeTime.snapshot(),
+		Connect:     make([]ConnectLatency, 0, len(s.connectTime)),
+		MiddleLogin: s.middleLoginTime.snapshot(),
+		Session:     s.sessionTime.snapshot(),
+	}
+	for _, k := range slices.SortedFunc(maps.Keys(s.connectTime), compareEgressKeys) {
+		latency.Connect = append(latency.Connect, ConnectLatency{
+			Egress:    k.egress,
+			DC:        k.dc,
+			Histogram: s.connectTime[k].snapshot(),
+		})
+	}
+	return latency
+}
+
+func (l Latency) AsString() string {
 	b := &strings.Builder{}
-	fmt.Fprintf(b, "Clients:\nTotal: %d\n\n", len(s.clients))
-	for name, count := range userStats {
-		fmt.Fprintf(b, "%s: %d\n", name, count)
+	fmt.Fprintf(b, "handshake: %s\n", l.Handshake)
+	for _, c := range l.Connect {
+		fmt.Fprintf(b, "connect %s dc %d: %s\n", c.Egress, c.DC, c.Histogram)
+	}
+	fmt.Fprintf(b, "middle proxy login: %s\n", l.MiddleLogin)
+	fmt.Fprintf(b, "session: %s\n", l.Session)
+	return b.String()
+}
+
+func (s *Stats) AsString() string {
+	summary := s.Summary()
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "Clients:\nTotal: %d\n\n", summary.Total)
+	for _, name := range slices.Sorted(maps.Keys(summary.Users)) {
+		fmt.Fprintf(b, "%s: %d\n", name, summary.Users[name])
+	}
+	fmt.Fprintf(b, "\nfallbacks: %d\n", summary.Fallbacks)
+	fmt.Fprintf(b, "\nTraffic:\n")
+	for _, name := range slices.Sorted(maps.Keys(summary.Traffic)) {
+		t := summary.Traffic[name]
+		fmt.Fprintf(b, "%s: up %d bytes %d msgs, down %d bytes %d msgs\n",
+			name, t.BytesUp, t.MsgsUp, t.BytesDown, t.MsgsDown)
+	}
+	fmt.Fprintf(b, "\nClosed:\n")
+	for _, reason := range slices.Sorted(maps.Keys(summary.Closed)) {
+		fmt.Fprintf(b, "%s: %d\n", reason, summary.Closed[reason])
 	}
-	fmt.Fprintf(b, "\nfallbacks: %d\n", fallbacks)
 	return b.String()
 }
@@ -0,0 +1,206 @@
+package stats
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestUserTrafficSurvivesRemove(t *testing.T) {
+	s := New()
+	first := s.AllocClient(nil, "test")
+	first.SetAuthorized("user")
+	first.CountUp(10, 1)
+	first.CountDown(20, 2)
+	first.Close()
+	second := s.AllocClient(nil, "test")
+	second.SetAuthorized("user")
+	second.CountUp(5, 1)
+	traffic := s.UserTraffic()["user"]
+	expected := Traffic{BytesUp: 15, BytesDown: 20, MsgsUp: 2, MsgsDown: 2}
+	if traffic != expected {
+		t.Errorf("unexpected traffic %+v", traffic)
+	}
+	second.Close()
+	if s.UserTraffic()["user"] != expected {
+		t.Errorf("traffic lost after remove")
+	}
+}
+
+// connection with fixed remote address, records Close calls
+type testConn struct {
+	net.Conn
+	remote net.Addr
+	closed bool
+}
+
+func (c *testConn) RemoteAddr() net.Addr { return c.remote }
+func (c *testConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestKick(t *testing.T) {
+	s := New()
+	conns := []*testConn{}
+	handles := []*StatsHandle{}
+	for i, name := range []string{"a", "a", "b"} {
+		conn := &testConn{remote: &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 1000}}
+		h := s.AllocClient(conn, "test")
+		h.SetAuthorized(name)
+		conns = append(conns, conn)
+		handles = append(handles, h)
+	}
+	if s.KickUser("a") != 2 || !conns[0].closed || !conns[1].closed || conns[2].closed {
+		t.Errorf("kick by user closed wrong connections")
+	}
+	if s.KickIP(netip.MustParseAddr("10.0.0.2")) != 1 || !conns[2].closed {
+		t.Errorf("kick by ip failed")
+	}
+	if s.KickID(handles[0].ID()) != 1 || s.KickID(100) != 0 {
+		t.Errorf("kick by id failed")
+	}
+	handles[0].Close()
+	if s.Summary().Closed[ReasonKicked] != 1 {
+		t.Errorf("kick reason not recorded")
+	}
+}
+
+func TestAuthorizeLimits(t *testing.T) {
+	s := New()
+	alloc := func(ip byte) *StatsHandle {
+		return s.AllocClient(&testConn{remote: &net.TCPAddr{IP: net.IPv4(10, 0, 0, ip), Port: 1000}}, "test")
+	}
+	limits := UserLimits{MaxConnections: 3, MaxIPs: 2}
+	for _, ip := range []byte{1, 2, 1} {
+		if reason := alloc(ip).Authorize("user", limits); reason != "" {
+			t.Errorf("session refused: %s", reason)
+		}
+	}
+	if reason := alloc(1).Authorize("user", limits); reason != ReasonMaxConnections {
+		t.Errorf("max_connections not enforced: %q", reason)
+	}
+	limits.MaxConnections = 0
+	if reason := alloc(3).Authorize("user", limits); reason != ReasonMaxIPs {
+		t.Errorf("max_ips not enforced: %q", reason)
+	}
+	if reason := alloc(2).Authorize("user", limits); reason != "" {
+		t.Errorf("known ip refused: %s", reason)
+	}
+	refused := s.Users()["user"].Refused
+	if refused[ReasonMaxConnections] != 1 || refused[ReasonMaxIPs] != 1 {
+		t.Errorf("refusals not counted: %v", refused)
+	}
+}
+
+func TestRefuse(t *testing.T) {
+	s := New()
+	alloc := func() *StatsHandle {
+		return s.AllocClient(&testConn{remote: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}}, "test")
+	}
+	ip := alloc()
+	ip.Refuse("user", ReasonIPNotAllowed)
+	// secret is matched, but dc is refused before authorization
+	dc := alloc()
+	dc.SetSecret("0")
+	dc.Refuse("user", ReasonDcNotAllowed)
+	// checked limits don't hold connection slot
+	checked := alloc()
+	if reason := checked.CheckLimits("user", UserLimits{MaxConnections: 1}); reason != "" {
+		t.Errorf("limits check refused: %s", reason)
+	}
+	if reason := alloc().Authorize("user", UserLimits{MaxConnections: 1}); reason != "" {
+		t.Errorf("refused session holds connection slot: %s", reason)
+	}
+	if reason := checked.CheckLimits("user", UserLimits{MaxConnections: 1}); reason != ReasonMaxConnections {
+		t.Errorf("limits check not refused: %q", reason)
+	}
+	ip.Close()
+	dc.Close()
+	checked.Close()
+	u := s.Users()["user"]
+	if u.Refused[ReasonIPNotAllowed] != 1 || u.Refused[ReasonDcNotAllowed] != 1 || u.Refused[ReasonMaxConnections] != 1 {
+		t.Errorf("refusals not counted: %v", u.Refused)
+	}
+	if u.Sessions != 1 || len(s.UserTotals()["user"].Secrets) != 0 {
+		t.Errorf("refused session counted: %+v", s.UserTotals()["user"])
+	}
+	summary := s.Summary()
+	if summary.Closed[ReasonDcNotAllowed] != 1 || summary.Closed[ReasonIPNotAllowed] != 1 {
+		t.Errorf("close reasons not set")
+	}
+	if summary.Handshakes[HandshakeOk] != 1 || summary.Handshakes[HandshakeRefused] != 3 {
+		t.Errorf("unexpected handshakes %v", summary.Handshakes)
+	}
+}
+
+func TestSecretUsage(t *testing.T) {
+	s := New()
+	old := s.AllocClient(nil, "test")
+	old.SetSecret("old")
+	old.SetAuthorized("user")
+	old.Close()
+	for range 2 {
+		sh := s.AllocClient(nil, "test")
+		sh.SetSecret("new")
+		sh.SetAuthorized("user")
+	}
+	secrets := s.Users()["user"].Secrets
+	if secrets["old"].Sessions != 1 || secrets["old"].Connections != 0 {
+		t.Errorf("unexpected usage of old secret %+v", secrets["old"])
+	}
+	if secrets["new"].Sessions != 2 || secrets["new"].Connections != 2 {
+		t.Errorf("unexpected usage of new secret %+v", secrets["new"])
+	}
+	if !secrets["new"].LastUsed.After(secrets["old"].LastUsed) {
+		t.Errorf("last use of active secret not updated")
+	}
+	loaded := New()
+	loaded.AddUserTotals(s.UserTotals())
+	loaded.AddUserTotals(s.UserTotals())
+	if loaded.Users()["user"].Secrets["new"].Sessions != 4 {
+		t.Errorf("secret usage not merged from state")
+	}
+}
+
+func TestWaitEmpty(t *testing.T) {
+	s := New()
+	handles := []*StatsHandle{s.AllocClient(nil, "test"), s.AllocClient(nil, "test")}
+	if s.WaitEmpty(10 * time.Millisecond) {
+		t.Errorf("wait with active sessions succeeded")
+	}
+	go func() {
+		for _, h := range handles {
+			time.Sleep(50 * time.Millisecond)
+			h.Close()
+		}
+	}()
+	start := time.Now()
+	if !s.WaitEmpty(5 * time.Second) {
+		t.Errorf("wait failed after last session ended")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("wait returned %s after last session ended", elapsed)
+	}
+}
+
+func TestCloseAll(t *testing.T) {
+	s := New()
+	conns := []*testConn{}
+	for i := range 3 {
+		conn := &testConn{remote: &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 1000}}
+		s.AllocClient(conn, "test")
+		conns = append(conns, conn)
+	}
+	// connection without socket yet is skipped
+	s.AllocClient(nil, "test")
+	if closed := s.CloseAll(); closed != 3 {
+		t.Errorf("closed %d connections", closed)
+	}
+	for i, conn := range conns {
+		if !conn.closed {
+			t.Errorf("connection %d not closed", i)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package tgcrypt_encryption
 
 import (
+	"crypto/rand"
 	"encoding/hex"
 	"fmt"
 )
@@ -15,6 +16,12 @@ const (
 	FakeTLS SecretType = 3
 )
 
+// tags used by clients for secured and faketls secrets
+const (
+	SecuredTag byte = 0xdd
+	FakeTLSTag byte = 0xee
+)
+
 type Secret struct {
 	RawSecret []byte
 	Type      SecretType
@@ -66,3 +73,39 @@ func NewSecret(secret []byte) (*Secret, error) {
 		return nil, &ErrSecretLength{length: len(secret)}
 	}
 }
+
+// Generate random secret of specified type. Fakehost is used only for FakeTLS
+// secrets.
+func GenerateSecret(secretType SecretType, fakehost string) (*Secret, error) {
+	raw := make([]byte, simpleSecretLen)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch secretType {
+	case Simple:
+		return &Secret{RawSecret: raw, Type: Simple}, nil
+	case Secured:
+		return &Secret{RawSecret: raw, Type: Secured, Tag: SecuredTag}, nil
+	case FakeTLS:
+		if fakehost == "" {
+			return nil, fmt.Errorf("faketls secret requires host")
+		}
+		return &Secret{RawSecret: raw, Type: FakeTLS, Tag: FakeTLSTag, Fakehost: fakehost}, nil
+	default:
+		return nil, fmt.Errorf("unknown secret type: %d", secretType)
+	}
+}
+
+// Hex representation of secret as used in config and links
+func (s *Secret) Hex() string {
+	switch s.Type {
+	case Secured:
+		return hex.EncodeToString(append([]byte{s.Tag}, s.RawSecret...))
+	case FakeTLS:
+		b := append([]byte{s.Tag}, s.RawSecret...)
+		return hex.EncodeToString(append(b, s.Fakehost...))
+	default:
+		return hex.EncodeToString(s.RawSecret)
+	}
+}
@@ -48,3 +48,26 @@ func TeestSecretError(t *testing.T) {
 		t.Errorf("Wrong secret length passed %d", len(secretBytes))
 	}
 }
+
+func TestGenerateSecret(t *testing.T) {
+	for _, secretType := range []SecretType{Simple, Secured, FakeTLS} {
+		generated, err := GenerateSecret(secretType, "google.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		secret, err := NewSecretHex(generated.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secret.Type != secretType {
+			t.Errorf("Wrong secret type expected %d found %d", secretType, secret.Type)
+		}
+		if secret.Hex() != generated.Hex() {
+			t.Errorf("Wrong secret expected %s found %s", generated.Hex(), secret.Hex())
+		}
+	}
+	_, err := GenerateSecret(FakeTLS, "")
+	if err == nil {
+		t.Errorf("FakeTLS secret generated without host")
+	}
+}